@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"path"
+)
+
+// backupStats summarizes the contents of a backup or restore.
+type backupStats struct {
+	Files int
+	Bytes int64
+}
+
+// backupDirectory writes the contents of dir in the share (the whole share
+// if dir is empty) to w as a gzip-compressed tar archive. Paths in the
+// archive are relative to dir.
+func backupDirectory(files *fileAPI, share, dir string, w io.Writer) (backupStats, error) {
+	var stats backupStats
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	if err := backupTree(files, share, dir, "", tw, &stats); err != nil {
+		return stats, err
+	}
+	if err := tw.Close(); err != nil {
+		return stats, fmt.Errorf("cannot finish archive: %v", err)
+	}
+	if err := gz.Close(); err != nil {
+		return stats, fmt.Errorf("cannot finish archive: %v", err)
+	}
+	return stats, nil
+}
+
+// backupTree adds the entries under root/rel in the share to the archive,
+// recursively.
+func backupTree(files *fileAPI, share, root, rel string, tw *tar.Writer, stats *backupStats) error {
+	entries, err := files.ListDirectory(share, path.Join(root, rel))
+	if err != nil {
+		return fmt.Errorf("cannot list %q: %v", path.Join(root, rel), err)
+	}
+	for _, e := range entries {
+		name := path.Join(rel, e.Name)
+		remote := path.Join(root, name)
+		if e.IsDir {
+			mtime, err := files.GetDirectoryModTime(share, remote)
+			if err != nil {
+				return fmt.Errorf("cannot get properties of %q: %v", remote, err)
+			}
+			if err := tw.WriteHeader(&tar.Header{
+				Name:     name + "/",
+				Mode:     0755,
+				ModTime:  mtime,
+				Typeflag: tar.TypeDir,
+			}); err != nil {
+				return fmt.Errorf("cannot write archive: %v", err)
+			}
+			if err := backupTree(files, share, root, name, tw, stats); err != nil {
+				return err
+			}
+			continue
+		}
+
+		body, size, mtime, err := files.GetFile(share, remote)
+		if err != nil {
+			return fmt.Errorf("cannot read %q: %v", remote, err)
+		}
+		err = tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     size,
+			ModTime:  mtime,
+			Typeflag: tar.TypeReg,
+		})
+		if err == nil {
+			_, err = io.Copy(tw, body)
+		}
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("cannot archive %q: %v", remote, err)
+		}
+		stats.Files++
+		stats.Bytes += size
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// readArchive returns the names of the entries of a gzip-compressed tar
+// archive and the contents of its regular files.
+func readArchive(t *testing.T, r io.Reader) ([]string, map[string]string) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	contents := make(map[string]string)
+	mtime := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+		if !hdr.ModTime.Equal(mtime) {
+			t.Errorf("%s: got modification time %v, want %v", hdr.Name, hdr.ModTime, mtime)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			b, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if int64(len(b)) != hdr.Size {
+				t.Errorf("%s: got %d bytes, header says %d", hdr.Name, len(b), hdr.Size)
+			}
+			contents[hdr.Name] = string(b)
+		}
+	}
+	return names, contents
+}
+
+func TestBackupDirectory(t *testing.T) {
+	tree := newFakeShareTree("shared/vols/v1/f1", "shared/vols/v1/sub/f2", "shared/vols/v1/sub/deeper/f3",
+		"shared/vols/v1/empty/", "shared/vols/v10/other", "shared/top")
+	srv := httptest.NewServer(tree)
+	defer srv.Close()
+	files := testFileAPI(t, srv.URL+"/devstoreaccount1")
+
+	cases := []struct {
+		dir      string
+		names    []string
+		contents map[string]string
+	}{
+		{
+			"vols/v1",
+			[]string{"empty/", "sub/", "sub/deeper/", "sub/deeper/f3", "sub/f2", "f1"},
+			map[string]string{"f1": "content of f1", "sub/f2": "content of f2", "sub/deeper/f3": "content of f3"},
+		},
+		{
+			"", // the whole share
+			[]string{"vols/", "vols/v1/", "vols/v1/empty/", "vols/v1/sub/", "vols/v1/sub/deeper/", "vols/v1/sub/deeper/f3",
+				"vols/v1/sub/f2", "vols/v1/f1", "vols/v10/", "vols/v10/other", "top"},
+			map[string]string{"vols/v1/f1": "content of f1", "vols/v1/sub/f2": "content of f2",
+				"vols/v1/sub/deeper/f3": "content of f3", "vols/v10/other": "content of other", "top": "content of top"},
+		},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		stats, err := backupDirectory(files, "shared", c.dir, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names, contents := readArchive(t, &buf)
+		if !reflect.DeepEqual(names, c.names) {
+			t.Errorf("%q: got entries %q, want %q", c.dir, names, c.names)
+		}
+		if !reflect.DeepEqual(contents, c.contents) {
+			t.Errorf("%q: got contents %q, want %q", c.dir, contents, c.contents)
+		}
+		var size int64
+		for _, s := range c.contents {
+			size += int64(len(s))
+		}
+		if stats.Files != len(c.contents) || stats.Bytes != size {
+			t.Errorf("%q: got %+v, want %d files, %d bytes", c.dir, stats, len(c.contents), size)
+		}
+	}
+
+	if _, err := backupDirectory(files, "shared", "missing", ioutil.Discard); err == nil {
+		t.Error("backup of a missing directory succeeded")
+	}
+}
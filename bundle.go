@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// bundleVersion is the format version of volume metadata bundles.
+const bundleVersion = 1
+
+const (
+	conflictFail      = "fail"
+	conflictSkip      = "skip"
+	conflictOverwrite = "overwrite"
+)
+
+var allowedConflictModes = []string{conflictFail, conflictSkip, conflictOverwrite}
+
+// volumeBundle is the portable form of the volume metadata on a host, used to
+// move volume definitions to another host. It never contains account keys.
+type volumeBundle struct {
+	Version    int            `json:"version"`
+	ExportedAt time.Time      `json:"exported_at"`
+	Volumes    []bundleVolume `json:"volumes"`
+}
+
+// bundleVolume is a volume in a bundle. Metadata is kept as raw JSON so that
+// bundles written by older driver versions go through the metadata
+// migrations on import.
+type bundleVolume struct {
+	Name     string          `json:"name"`
+	Metadata json.RawMessage `json:"metadata"`
+}
+
+// exportVolumes writes all volume metadata records as a bundle to w and
+// returns the number of volumes exported.
+func exportVolumes(logctx *log.Entry, m *metadataDriver, w io.Writer) (int, error) {
+	vols, err := m.List(logctx)
+	if err != nil {
+		return 0, err
+	}
+	bundle := volumeBundle{
+		Version:    bundleVersion,
+		ExportedAt: time.Now().UTC(),
+		Volumes:    []bundleVolume{},
+	}
+	for _, name := range vols {
+		meta, err := m.Get(logctx, name)
+		if err != nil {
+			return 0, fmt.Errorf("volume %q: %v", name, err)
+		}
+		meta.Version = metadataVersion
+		b, err := json.Marshal(meta)
+		if err != nil {
+			return 0, fmt.Errorf("volume %q: cannot serialize metadata: %v", name, err)
+		}
+		bundle.Volumes = append(bundle.Volumes, bundleVolume{Name: name, Metadata: b})
+	}
+
+	enc, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return 0, fmt.Errorf("cannot serialize bundle: %v", err)
+	}
+	if _, err := w.Write(append(enc, '\n')); err != nil {
+		return 0, fmt.Errorf("cannot write bundle: %v", err)
+	}
+	return len(bundle.Volumes), nil
+}
+
+// importResult describes what happened to a volume from a bundle.
+type importResult struct {
+	Name    string
+	Account string
+	Action  string // "imported", "overwritten" or "skipped"
+	Reason  string // why it was skipped, if not obvious
+}
+
+// importVolumes reads a bundle from r and stores its volume metadata records.
+// conflict decides what happens to volumes that already exist on this host;
+// with conflictFail nothing is written if there is any conflict.
+func importVolumes(logctx *log.Entry, m *metadataDriver, r io.Reader, conflict string, dryRun bool) ([]importResult, error) {
+	var bundle volumeBundle
+	if err := json.NewDecoder(r).Decode(&bundle); err != nil {
+		return nil, fmt.Errorf("cannot parse bundle: %v", err)
+	}
+	if bundle.Version < 1 || bundle.Version > bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", bundle.Version)
+	}
+
+	// validate everything before writing anything
+	records := make([]volumeMetadata, len(bundle.Volumes))
+	seen := make(map[string]bool)
+	var conflicts []string
+	for i, vol := range bundle.Volumes {
+		if err := validateVolumeName(vol.Name); err != nil {
+			return nil, err
+		}
+		if seen[vol.Name] {
+			return nil, fmt.Errorf("volume %q appears more than once in the bundle", vol.Name)
+		}
+		seen[vol.Name] = true
+		meta, _, err := decodeMetadata(logctx.WithField("name", vol.Name), vol.Metadata)
+		if err != nil {
+			return nil, fmt.Errorf("volume %q: %v", vol.Name, err)
+		}
+		// the options are checked like those of a new volume, records
+		// from elsewhere may hold values this host would not accept
+		valid, err := m.Validate(meta.optionMap())
+		if err != nil {
+			return nil, fmt.Errorf("volume %q: invalid volume options: %v", vol.Name, err)
+		}
+		if err := validateShareName(valid.Options.Share); err != nil {
+			return nil, fmt.Errorf("volume %q: %v", vol.Name, err)
+		}
+		if valid.Options.Subdir && valid.Options.RemotePath == "" {
+			return nil, fmt.Errorf("volume %q: subdirectory volume has no 'remotepath'", vol.Name)
+		}
+		meta.Options, meta.Labels = valid.Options, valid.Labels
+		records[i] = meta
+		exists, err := m.Exists(vol.Name)
+		if err != nil {
+			return nil, fmt.Errorf("volume %q: %v", vol.Name, err)
+		}
+		if exists {
+			conflicts = append(conflicts, vol.Name)
+		}
+	}
+	if len(conflicts) > 0 && conflict == conflictFail {
+		return nil, fmt.Errorf("volumes already exist on this host: %v", conflicts)
+	}
+
+	var results []importResult
+	for i, vol := range bundle.Volumes {
+		res := importResult{Name: vol.Name, Account: records[i].Account, Action: "imported"}
+		if oneOf(vol.Name, conflicts) {
+			if conflict == conflictSkip {
+				res.Action = "skipped"
+				results = append(results, res)
+				continue
+			}
+			res.Action = "overwritten"
+		}
+		if !dryRun {
+			if err := m.Set(vol.Name, records[i]); err != nil {
+				return results, fmt.Errorf("volume %q: %v", vol.Name, err)
+			}
+		}
+		results = append(results, res)
+	}
+	return results, nil
+}
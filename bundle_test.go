@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestImportVolumesConflicts(t *testing.T) {
+	m, cleanup := testMetadataDriver(t)
+	defer cleanup()
+	writeRecord(t, m, "corrupt", `{"version":2,"opt`)
+	writeRecord(t, m, "existing", `{"version":2,"account":"old","options":{"share":"oldshare"}}`)
+
+	bundle := `{"version":1,"volumes":[
+		{"name":"corrupt","metadata":{"account":"acct","options":{"share":"share1"}}},
+		{"name":"existing","metadata":{"account":"acct","options":{"share":"share2"}}},
+		{"name":"new","metadata":{"version":2,"account":"acct","options":{"share":"share3"}}}]}`
+
+	if _, err := importVolumes(log.NewEntry(log.StandardLogger()), m, strings.NewReader(bundle), conflictFail, true); err == nil ||
+		!strings.Contains(err.Error(), "[corrupt existing]") {
+		t.Errorf("got error %v, want conflicts [corrupt existing]", err)
+	}
+
+	results, err := importVolumes(log.NewEntry(log.StandardLogger()), m, strings.NewReader(bundle), conflictSkip, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var actions []string
+	for _, r := range results {
+		actions = append(actions, r.Name+":"+r.Action)
+	}
+	if got, want := strings.Join(actions, " "), "corrupt:skipped existing:skipped new:imported"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// a dry run leaves every record where it is
+	if _, err := ioutil.ReadFile(filepath.Join(m.metaDir, "corrupt")); err != nil {
+		t.Errorf("corrupt record moved by dry run: %v", err)
+	}
+	if ok, _ := m.Exists("new"); ok {
+		t.Error("dry run wrote a record")
+	}
+
+	if _, err := importVolumes(log.NewEntry(log.StandardLogger()), m, strings.NewReader(bundle), conflictOverwrite, false); err != nil {
+		t.Fatal(err)
+	}
+	if meta, err := m.Get(log.NewEntry(log.StandardLogger()), "existing"); err != nil || meta.Options.Share != "share2" {
+		t.Errorf("existing: got %+v, %v, want share2", meta, err)
+	}
+}
+
+func TestImportVolumesDuplicates(t *testing.T) {
+	m, cleanup := testMetadataDriver(t)
+	defer cleanup()
+
+	bundle := `{"version":1,"volumes":[
+		{"name":"vol","metadata":{"account":"acct","options":{"share":"share1"}}},
+		{"name":"vol","metadata":{"account":"acct","options":{"share":"share2"}}}]}`
+	if _, err := importVolumes(log.NewEntry(log.StandardLogger()), m, strings.NewReader(bundle), conflictOverwrite, false); err == nil ||
+		!strings.Contains(err.Error(), "more than once") {
+		t.Errorf("got error %v, want duplicate error", err)
+	}
+	if ok, _ := m.Exists("vol"); ok {
+		t.Error("record written despite duplicate")
+	}
+}
+
+func TestImportVolumesInvalidOptions(t *testing.T) {
+	m, cleanup := testMetadataDriver(t)
+	defer cleanup()
+
+	cases := map[string]string{
+		`{"share":"share1","vers":"3.0,ip=10.0.0.9"}`:      "invalid value for 'vers'",
+		`{"share":"share1","cache":"strict,sec=none"}`:     "invalid value for 'cache'",
+		`{"share":"share1","actimeo":"1,domain=x"}`:        "invalid value for 'actimeo'",
+		`{"share":"share1","filemode":"0644,uid=0"}`:       "invalid value for 'filemode'",
+		`{"share":"share1","uid":"0,cred=/etc/shadow"}`:    "invalid value for 'uid'",
+		`{"share":"share1","remotepath":"a/../b"}`:         "invalid value for 'remotepath'",
+		`{"share":"share1","removepolicy":"shred"}`:        "invalid value for 'removepolicy'",
+		`{"share":"share1","subdir":true}`:                 "subdirectory volume has no 'remotepath'",
+		`{"share":"share1","subdir":true,"remotepath":""}`: "subdirectory volume has no 'remotepath'",
+		`{"share":"Share_1"}`:                              "invalid value for 'share'",
+		`{}`:                                               "must be 3 to 63 characters long",
+	}
+	for opts, want := range cases {
+		bundle := `{"version":1,"volumes":[{"name":"vol","metadata":{"version":2,"account":"acct","options":` + opts + `}}]}`
+		_, err := importVolumes(log.NewEntry(log.StandardLogger()), m, strings.NewReader(bundle), conflictFail, false)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: got error %v, want %q", opts, err, want)
+		}
+		if ok, _ := m.Exists("vol"); ok {
+			t.Fatalf("%s: record written", opts)
+		}
+	}
+
+	bundle := `{"version":1,"volumes":[{"name":"vol","metadata":{"version":2,"account":"acct",
+		"options":{"share":"share1","subdir":true,"remotepath":"/dir/vol/","vers":"3.0","filemode":"644"},
+		"labels":{"team":"infra"}}}]}`
+	if _, err := importVolumes(log.NewEntry(log.StandardLogger()), m, strings.NewReader(bundle), conflictFail, false); err != nil {
+		t.Fatal(err)
+	}
+	meta, err := m.Get(log.NewEntry(log.StandardLogger()), "vol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o := meta.Options; o.RemotePath != "dir/vol" || o.FileMode != "0644" || !o.Subdir || meta.Labels["team"] != "infra" {
+		t.Errorf("got %+v", meta)
+	}
+}
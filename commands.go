@@ -0,0 +1,386 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/codegangsta/cli"
+)
+
+// commands returns the maintenance commands available besides running the
+// volume driver, which is the default action.
+func commands() []cli.Command {
+	return []cli.Command{
+		{
+			Name:  "migrate-metadata",
+			Usage: "Upgrade stored volume metadata to the current schema version",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only report the volumes that would be upgraded",
+				},
+			},
+			Action: migrateMetadataCommand,
+		},
+		{
+			Name:  "import-shares",
+			Usage: "Create volumes for existing Azure File shares in the account",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "prefix",
+					Usage: "only import shares whose names start with the prefix",
+				},
+				cli.StringSliceFlag{
+					Name:  "metadata-filter",
+					Usage: "only import shares with the share metadata key=value (repeatable)",
+					Value: &cli.StringSlice{},
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only report the shares that would be imported",
+				},
+			},
+			Action: importSharesCommand,
+		},
+		{
+			Name:   "export-volumes",
+			Usage:  "Write the metadata of all volumes to a bundle: export-volumes <file|->",
+			Action: exportVolumesCommand,
+		},
+		{
+			Name:  "import-volumes",
+			Usage: "Create volumes from a bundle written by export-volumes: import-volumes <file|->",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "on-conflict",
+					Usage: "what to do with volumes that already exist: fail, skip or overwrite",
+					Value: conflictFail,
+				},
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only report what would be imported",
+				},
+			},
+			Action: importVolumesCommand,
+		},
+		{
+			Name:   "backup",
+			Usage:  "Archive the data of a volume through the File REST API: backup <volume> <file.tar.gz>",
+			Action: backupCommand,
+		},
+		{
+			Name:  "restore",
+			Usage: "Upload a tar archive or a directory into a volume through the File REST API: restore <volume> <file.tar[.gz]|dir>",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "parallel",
+					Usage: "maximum number of upload requests in flight at the same time",
+					Value: defaultRestoreParallelism,
+				},
+			},
+			Action: restoreCommand,
+		},
+	}
+}
+
+// storageCredentials returns the storage account settings from the global
+// options, exiting if they are missing or invalid.
+func storageCredentials(c *cli.Context) (accountName, accountKey string, endpoint *url.URL) {
+	accountName = c.GlobalString("account-name")
+	accountKey = c.GlobalString("account-key")
+	if accountName == "" || accountKey == "" {
+		log.Fatal("azure storage account name and key must be provided.")
+	}
+	endpoint, err := fileEndpoint(accountName, c.GlobalString("storage-base"), c.GlobalString("file-endpoint"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return
+}
+
+func migrateMetadataCommand(c *cli.Context) {
+	meta, err := newMetadataDriver(c.GlobalString("metadata"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	dryRun := c.Bool("dry-run")
+	migrated, err := meta.Migrate(log.WithField("operation", "migrate-metadata"), dryRun)
+	for _, name := range migrated {
+		if dryRun {
+			fmt.Printf("would upgrade %s\n", name)
+		} else {
+			fmt.Printf("upgraded %s\n", name)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dryRun {
+		fmt.Printf("%d volume(s) need upgrading to metadata version %d\n", len(migrated), metadataVersion)
+	} else {
+		fmt.Printf("%d volume(s) upgraded to metadata version %d\n", len(migrated), metadataVersion)
+	}
+}
+
+func importSharesCommand(c *cli.Context) {
+	accountName, accountKey, endpoint := storageCredentials(c)
+	filters := make(map[string]string)
+	for _, f := range c.StringSlice("metadata-filter") {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			log.Fatalf("invalid metadata filter %q, expected key=value", f)
+		}
+		filters[strings.ToLower(kv[0])] = kv[1]
+	}
+	dryRun := c.Bool("dry-run")
+
+	files, err := newFileAPI(accountName, accountKey, endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	meta, err := newMetadataDriver(c.GlobalString("metadata"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	results, err := importShares(log.WithField("operation", "import-shares"), files, meta, accountName, c.String("prefix"), filters, dryRun)
+	var adopted int
+	for _, r := range results {
+		if r.Action == "skipped" {
+			fmt.Printf("skipped %s: %s\n", r.Name, r.Reason)
+			continue
+		}
+		fmt.Printf("imported %s\n", r.Name)
+		adopted++
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dryRun {
+		fmt.Printf("%d share(s) would be imported\n", adopted)
+	} else {
+		fmt.Printf("%d share(s) imported\n", adopted)
+	}
+}
+
+// importShares creates a volume named after each share in the account whose
+// name starts with prefix and whose metadata has all the filters. Shares used
+// by volumes, or named like an existing volume, are skipped.
+func importShares(logctx *log.Entry, files *fileAPI, meta *metadataDriver, account, prefix string, filters map[string]string, dryRun bool) ([]importResult, error) {
+	shares, err := files.ListShares(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list shares: %v", err)
+	}
+
+	var results []importResult
+	for _, sh := range shares {
+		if !matchesMetadata(sh.Metadata, filters) {
+			continue
+		}
+		res := importResult{Name: sh.Name, Account: account, Action: "skipped"}
+		refs, err := meta.References(logctx, sh.Name)
+		if err != nil {
+			return results, err
+		}
+		if len(refs) > 0 {
+			res.Reason = fmt.Sprintf("already used by volumes %v", refs)
+			results = append(results, res)
+			continue
+		}
+		exists, err := meta.Exists(sh.Name)
+		if err != nil {
+			return results, err
+		}
+		if exists {
+			res.Reason = "a volume with the same name exists"
+			results = append(results, res)
+			continue
+		}
+		if !dryRun {
+			if err := meta.Set(sh.Name, volumeMetadata{
+				CreatedAt: time.Now().UTC(),
+				Account:   account,
+				Options:   VolumeOptions{Share: sh.Name},
+			}); err != nil {
+				return results, err
+			}
+		}
+		res.Action = "imported"
+		results = append(results, res)
+	}
+	return results, nil
+}
+
+// matchesMetadata reports whether metadata has all key/value pairs in
+// filters. Keys are expected in lowercase.
+func matchesMetadata(metadata, filters map[string]string) bool {
+	for k, v := range filters {
+		if metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func exportVolumesCommand(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Fatal("usage: export-volumes <file>")
+	}
+	meta, err := newMetadataDriver(c.GlobalString("metadata"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	file := c.Args().First()
+	out := os.Stdout
+	if file != "-" {
+		if out, err = os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600); err != nil {
+			log.Fatal(err)
+		}
+	}
+	n, err := exportVolumes(log.WithField("operation", "export-volumes"), meta, out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if file != "-" {
+		if err := out.Close(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%d volume(s) exported to %s\n", n, file)
+	}
+}
+
+func importVolumesCommand(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		log.Fatal("usage: import-volumes <file>")
+	}
+	conflict := c.String("on-conflict")
+	if !oneOf(conflict, allowedConflictModes) {
+		log.Fatalf("invalid value for --on-conflict: %q (allowed: %v)", conflict, allowedConflictModes)
+	}
+	meta, err := newMetadataDriver(c.GlobalString("metadata"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	file := c.Args().First()
+	in := os.Stdin
+	if file != "-" {
+		if in, err = os.Open(file); err != nil {
+			log.Fatal(err)
+		}
+		defer in.Close()
+	}
+	results, err := importVolumes(log.WithField("operation", "import-volumes"), meta, in, conflict, c.Bool("dry-run"))
+	account := c.GlobalString("account-name")
+	for _, r := range results {
+		fmt.Printf("%s %s\n", r.Action, r.Name)
+		if account != "" && r.Account != account && r.Action != "skipped" {
+			fmt.Printf("  warning: volume is on storage account %q, the driver uses %q and will not mount it\n", r.Account, account)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func backupCommand(c *cli.Context) {
+	if len(c.Args()) != 2 {
+		log.Fatal("usage: backup <volume> <file.tar.gz>")
+	}
+	name, file := c.Args()[0], c.Args()[1]
+	accountName, accountKey, endpoint := storageCredentials(c)
+	vol := volumeForCommand(c, name, accountName)
+
+	files, err := newFileAPI(accountName, accountKey, endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// write to a temporary file so that a failed backup does not leave a
+	// truncated archive behind under the requested name
+	tmp := file + ".partial"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	stats, err := backupDirectory(files, vol.Options.Share, vol.Options.RemotePath, out)
+	if err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Fatalf("backup of volume %q failed: %v", name, err)
+	}
+	fmt.Printf("backed up %d file(s), %d byte(s) of volume %s to %s\n", stats.Files, stats.Bytes, name, file)
+}
+
+func restoreCommand(c *cli.Context) {
+	if len(c.Args()) != 2 {
+		log.Fatal("usage: restore <volume> <file.tar[.gz]|dir>")
+	}
+	name, src := c.Args()[0], c.Args()[1]
+	accountName, accountKey, endpoint := storageCredentials(c)
+	vol := volumeForCommand(c, name, accountName)
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	files, err := newFileAPI(accountName, accountKey, endpoint)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if vol.Options.RemotePath != "" {
+		if err := files.CreateDirectoryAll(vol.Options.Share, vol.Options.RemotePath); err != nil {
+			log.Fatalf("restore of volume %q failed: %v", name, err)
+		}
+	}
+
+	u := newUploader(files, vol.Options.Share, vol.Options.RemotePath, c.Int("parallel"))
+	stop := make(chan struct{})
+	go u.reportProgress(restoreProgressInterval, stop)
+	if fi.IsDir() {
+		err = u.restoreDirectory(src)
+	} else {
+		var in *os.File
+		if in, err = os.Open(src); err == nil {
+			err = u.restoreArchive(in)
+			in.Close()
+		}
+	}
+	close(stop)
+	if err != nil {
+		log.Fatalf("restore of volume %q failed: %v", name, err)
+	}
+	stats := u.progress()
+	fmt.Printf("restored %d file(s), %d byte(s) from %s to volume %s\n", stats.Files, stats.Bytes, src, name)
+}
+
+// volumeForCommand returns the metadata of the named volume, exiting if the
+// volume does not exist or is on a different storage account.
+func volumeForCommand(c *cli.Context, name, accountName string) volumeMetadata {
+	if err := validateVolumeName(name); err != nil {
+		log.Fatal(err)
+	}
+	meta, err := newMetadataDriver(c.GlobalString("metadata"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	vol, err := meta.Get(log.WithField("name", name), name)
+	if err != nil {
+		log.Fatalf("volume %q: %v", name, err)
+	}
+	if vol.Account != accountName {
+		log.Fatalf("volume %q is on a different storage account ('%s')", name, vol.Account)
+	}
+	return vol
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// shareListing serves share listings with metadata, in pages of two shares,
+// honoring the prefix.
+func shareListing(shares map[string]map[string]string, names []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("comp") != "list" || q.Get("include") != "metadata" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var page []string
+		for _, n := range names {
+			if strings.HasPrefix(n, q.Get("prefix")) && n > q.Get("marker") {
+				page = append(page, n)
+			}
+		}
+		next := ""
+		if len(page) > 2 {
+			page, next = page[:2], page[1]
+		}
+		fmt.Fprint(w, "<EnumerationResults><Shares>")
+		for _, n := range page {
+			fmt.Fprintf(w, "<Share><Name>%s</Name><Metadata>", n)
+			for k, v := range shares[n] {
+				fmt.Fprintf(w, "<%s>%s</%s>", k, v, k)
+			}
+			fmt.Fprint(w, "</Metadata></Share>")
+		}
+		fmt.Fprintf(w, "</Shares><NextMarker>%s</NextMarker></EnumerationResults>", next)
+	}
+}
+
+func TestImportShares(t *testing.T) {
+	shares := map[string]map[string]string{
+		"app-data":   {"Env": "prod", "team": "web"},
+		"app-logs":   {"env": "prod"},
+		"app-test":   {"env": "test"},
+		"app-used":   {"env": "prod"},
+		"app-volume": {"env": "prod"},
+		"other-data": {"env": "prod"},
+	}
+	names := []string{"app-data", "app-logs", "app-test", "app-used", "app-volume", "other-data"}
+	srv := httptest.NewServer(shareListing(shares, names))
+	defer srv.Close()
+	files := testFileAPI(t, srv.URL+"/devstoreaccount1")
+	logctx := log.NewEntry(log.StandardLogger())
+
+	m, cleanup := testMetadataDriver(t)
+	defer cleanup()
+	writeRecord(t, m, "myvol", `{"version":2,"account":"acct","options":{"share":"app-used"}}`)
+	writeRecord(t, m, "app-volume", `{"version":2,"account":"acct","options":{"share":"somewhere"}}`)
+
+	summary := func(results []importResult) string {
+		var s []string
+		for _, r := range results {
+			s = append(s, r.Action+" "+r.Name)
+		}
+		return strings.Join(s, ", ")
+	}
+
+	// a dry run writes nothing
+	results, err := importShares(logctx, files, m, "acct", "app-", map[string]string{"env": "prod"}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "imported app-data, imported app-logs, skipped app-used, skipped app-volume"
+	if got := summary(results); got != want {
+		t.Errorf("dry run: got %s, want %s", got, want)
+	}
+	if results[2].Reason != "already used by volumes [myvol]" || results[3].Reason != "a volume with the same name exists" {
+		t.Errorf("got reasons %q, %q", results[2].Reason, results[3].Reason)
+	}
+	if ok, _ := m.Exists("app-data"); ok {
+		t.Error("dry run wrote a record")
+	}
+
+	results, err = importShares(logctx, files, m, "acct", "app-", map[string]string{"env": "prod", "team": "web"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := summary(results), "imported app-data"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	meta, err := m.Get(logctx, "app-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (VolumeOptions{Share: "app-data"}); meta.Account != "acct" || !reflect.DeepEqual(meta.Options, want) {
+		t.Errorf("got %+v", meta)
+	}
+
+	// without filters every share with the prefix matches, imported ones
+	// are now in use
+	results, err = importShares(logctx, files, m, "acct", "", nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = "skipped app-data, imported app-logs, imported app-test, skipped app-used, skipped app-volume, imported other-data"
+	if got := summary(results); got != want {
+		t.Errorf("no filters: got %s, want %s", got, want)
+	}
+}
@@ -2,47 +2,116 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	azure "github.com/Azure/azure-sdk-for-go/storage"
 	log "github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 )
 
+// driverConfig holds the settings of the volume driver.
+type driverConfig struct {
+	AccountName       string
+	AccountKey        string
+	StorageBase       string
+	Mountpoint        string
+	MetadataRoot      string
+	ShareNameTemplate string
+
+	// FileEndpoint overrides the File Service endpoint derived from the
+	// account name and StorageBase, e.g. for emulators.
+	FileEndpoint string
+
+	// SubdirShare is the share used for subdirectory volumes created
+	// without the 'share' option.
+	SubdirShare string
+
+	RemoveShares  bool
+	RemoveSubdirs bool
+
+	// MountTimeout limits how long mounting a volume may take, zero means
+	// no limit.
+	MountTimeout time.Duration
+
+	// Policy restricts the volumes that can be created, nil allows all.
+	Policy *volumePolicy
+}
+
 type volumeDriver struct {
-	m            sync.Mutex
-	cl           azure.FileServiceClient
-	meta         *metadataDriver
-	accountName  string
-	accountKey   string
-	storageBase  string
-	mountpoint   string
-	removeShares bool
-}
-
-func newVolumeDriver(accountName, accountKey, storageBase, mountpoint, metadataRoot string, removeShares bool) (*volumeDriver, error) {
-	storageClient, err := azure.NewClient(accountName, accountKey, storageBase, azure.DefaultAPIVersion, true)
+	m             sync.Mutex
+	files         *fileAPI
+	meta          *metadataDriver
+	accountName   string
+	accountKey    string
+	smbHost       string
+	mountpoint    string
+	subdirShare   string
+	removeShares  bool
+	removeSubdirs bool
+	mountTimeout  time.Duration
+	namer         *shareNamer
+	policy        *volumePolicy
+	hostname      string
+	usage         *usageCache
+}
+
+// maxShareNameAttempts is the number of alternative generated share names
+// tried before giving up when the generated names collide with existing shares.
+const maxShareNameAttempts = 5
+
+func newVolumeDriver(cfg driverConfig) (*volumeDriver, error) {
+	endpoint, err := fileEndpoint(cfg.AccountName, cfg.StorageBase, cfg.FileEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	files, err := newFileAPI(cfg.AccountName, cfg.AccountKey, endpoint)
 	if err != nil {
-		return nil, fmt.Errorf("error creating azure client: %v", err)
+		return nil, fmt.Errorf("error creating azure file api client: %v", err)
 	}
-	metaDriver, err := newMetadataDriver(metadataRoot)
+	metaDriver, err := newMetadataDriver(cfg.MetadataRoot)
 	if err != nil {
 		return nil, fmt.Errorf("cannot initialize metadata driver: %v", err)
 	}
+	namer, err := newShareNamer(cfg.ShareNameTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SubdirShare != "" {
+		if err := validateShareName(cfg.SubdirShare); err != nil {
+			return nil, fmt.Errorf("invalid subdirectory volume share: %v", err)
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		log.Warnf("cannot determine host name for share metadata: %v", err)
+	}
 	return &volumeDriver{
-		cl:           storageClient.GetFileService(),
-		meta:         metaDriver,
-		accountName:  accountName,
-		accountKey:   accountKey,
-		storageBase:  storageBase,
-		mountpoint:   mountpoint,
-		removeShares: removeShares,
+		files:         files,
+		meta:          metaDriver,
+		accountName:   cfg.AccountName,
+		accountKey:    cfg.AccountKey,
+		smbHost:       endpointHost(endpoint),
+		mountpoint:    cfg.Mountpoint,
+		subdirShare:   cfg.SubdirShare,
+		removeShares:  cfg.RemoveShares,
+		removeSubdirs: cfg.RemoveSubdirs,
+		mountTimeout:  cfg.MountTimeout,
+		namer:         namer,
+		policy:        cfg.Policy,
+		hostname:      hostname,
+		usage:         newUsageCache(usageCacheTTL),
 	}, nil
 }
 
@@ -52,17 +121,37 @@ func (v *volumeDriver) Capabilities(req volume.Request) (resp volume.Response) {
 }
 
 func (v *volumeDriver) Create(req volume.Request) (resp volume.Response) {
-	v.m.Lock()
+	sp := startSpan(nil, "VolumeDriver.Create")
+	defer func() { sp.Finish(resp.Err) }()
+	v.lock(sp)
 	defer v.m.Unlock()
 
+	id := newRequestID("")
+	defer annotateError(&resp, id)
+	sp.SetAttribute("request.id", id)
+	sp.SetAttribute("volume.name", req.Name)
 	logctx := log.WithFields(log.Fields{
 		"operation": "create",
 		"name":      req.Name,
-		"options":   req.Options})
+		"options":   req.Options,
+		"requestID": id})
+	files := v.files.withRequest(id, sp)
+
+	if err := validateVolumeName(req.Name); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
 
 	volMeta, err := v.meta.Validate(req.Options)
 	if err != nil {
-		resp.Err = fmt.Sprintf("error validating metadata: %v", err)
+		resp.Err = fmt.Sprintf("invalid volume options: %v", err)
+		logctx.Error(resp.Err)
+		return
+	}
+
+	if err := v.policy.checkVolume(v.accountName, req.Options, volMeta.Options); err != nil {
+		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
 	}
@@ -71,22 +160,112 @@ func (v *volumeDriver) Create(req volume.Request) (resp volume.Response) {
 	volMeta.Account = v.accountName
 	volMeta.CreatedAt = time.Now().UTC()
 
-	share := req.Options["share"]
+	logctx.Debug("request accepted")
+
+	if volMeta.Options.Subdir {
+		// Subdirectory volumes live in a directory named after the volume
+		// unless told otherwise, on a share shared with other volumes.
+		if volMeta.Options.Share == "" {
+			if v.subdirShare == "" {
+				resp.Err = "missing volume option 'share' for subdirectory volume (no --subdir-share configured)"
+				logctx.Error(resp.Err)
+				return
+			}
+			volMeta.Options.Share = v.subdirShare
+		}
+		if volMeta.Options.RemotePath == "" {
+			if volMeta.Options.RemotePath, err = parseRemotePath(req.Name); err != nil {
+				resp.Err = fmt.Sprintf("volume name cannot be used as directory name: %v", err)
+				logctx.Error(resp.Err)
+				return
+			}
+		}
+	}
+
+	share := volMeta.Options.Share
+	created := false // whether the share is created for this volume
+
+	// A share created for the volume is deleted again if the volume cannot
+	// be created, so that no share is left behind without a volume.
+	defer func() {
+		if created && resp.Err != "" {
+			v.removeCreatedShare(logctx, files, req.Name, share)
+		}
+	}()
 	if share == "" {
-		resp.Err = "missing volume option: 'share'"
+		// Pick a share name for the volume unless the volume already exists,
+		// in which case keep using its share.
+		if existing, err := v.meta.Get(logctx, req.Name); err == nil && existing.Options.Share != "" {
+			share = existing.Options.Share
+		} else if share, err = v.createGeneratedShare(logctx, files, req.Name); err != nil {
+			resp.Err = err.Error()
+			logctx.Error(resp.Err)
+			return
+		} else {
+			created = true
+		}
+		volMeta.Options.Share = share
+		logctx.Infof("using azure file share %q", share)
+	}
+
+	if err := v.policy.checkShare(share); err != nil {
+		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
 	}
 
-	logctx.Debug("request accepted")
-
 	// Create azure file share
-	if ok, err := v.cl.CreateShareIfNotExists(share); err != nil {
+	if ok, err := files.CreateShareIfNotExists(share); err != nil {
 		resp.Err = fmt.Sprintf("error creating azure file share: %v", err)
 		logctx.Error(resp.Err)
 		return
 	} else if ok {
 		logctx.Infof("created azure file share %q", share)
+		created = true
+	}
+
+	// Tag the share so that it can be traced back to the volume. Shares
+	// that existed before, or that other subdirectory volumes use, are left
+	// alone.
+	if created && !volMeta.Options.Subdir {
+		if err := files.SetShareMetadata(share, shareMetadata(req.Name, v.hostname, volMeta.Labels)); err != nil {
+			logctx.Warnf("cannot set metadata of azure file share: %v", err)
+		}
+	}
+
+	// The quota is only set on shares created for the volume. A share that
+	// existed before may be used by other volumes or applications, so the
+	// volume is only accepted if the share is no larger than it asks for.
+	if quota := volMeta.Options.Quota; quota > 0 && created {
+		if err := files.SetShareQuota(share, quota); err != nil {
+			resp.Err = fmt.Sprintf("error setting quota of azure file share: %v", err)
+			logctx.Error(resp.Err)
+			return
+		}
+		logctx.Debugf("quota of share %q set to %d GiB", share, quota)
+	} else if quota > 0 {
+		current, err := files.ShareQuota(share)
+		if err != nil {
+			resp.Err = fmt.Sprintf("error getting quota of azure file share: %v", err)
+			logctx.Error(resp.Err)
+			return
+		}
+		if current > quota {
+			resp.Err = fmt.Sprintf("azure file share %q already exists with a quota of %d GiB, larger than the requested %d GiB", share, current, quota)
+			logctx.Error(resp.Err)
+			return
+		}
+		logctx.Debugf("keeping quota of existing share %q (%d GiB)", share, current)
+	}
+
+	if volMeta.Options.Subdir {
+		if err := files.CreateDirectoryAll(share, volMeta.Options.RemotePath); err != nil {
+			resp.Err = fmt.Sprintf("error creating volume directory: %v", err)
+			logctx.Error(resp.Err)
+			return
+		}
+		v.usage.forget(share, volMeta.Options.RemotePath)
+		logctx.Debugf("volume directory %q ready on share %q", volMeta.Options.RemotePath, share)
 	}
 
 	// Save volume metadata
@@ -99,35 +278,66 @@ func (v *volumeDriver) Create(req volume.Request) (resp volume.Response) {
 }
 
 func (v *volumeDriver) Path(req volume.Request) (resp volume.Response) {
-	v.m.Lock()
+	sp := startSpan(nil, "VolumeDriver.Path")
+	defer func() { sp.Finish(resp.Err) }()
+	v.lock(sp)
 	defer v.m.Unlock()
 
-	log.WithFields(log.Fields{
-		"operation": "path", "name": req.Name,
-	}).Debug("request accepted")
+	id := newRequestID("")
+	defer annotateError(&resp, id)
+	sp.SetAttribute("request.id", id)
+	sp.SetAttribute("volume.name", req.Name)
+	logctx := log.WithFields(log.Fields{
+		"operation": "path", "name": req.Name, "requestID": id,
+	})
+	if err := validateVolumeName(req.Name); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
+	logctx.Debug("request accepted")
 
-	resp.Mountpoint = v.pathForVolume(req.Name)
+	path, err := v.pathForVolume(req.Name)
+	if err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
+	resp.Mountpoint = path
 	return
 }
 
 func (v *volumeDriver) Mount(req volume.MountRequest) (resp volume.Response) {
-	v.m.Lock()
+	sp := startSpan(nil, "VolumeDriver.Mount")
+	defer func() { sp.Finish(resp.Err) }()
+	v.lock(sp)
 	defer v.m.Unlock()
 
+	id := newRequestID(req.ID)
+	defer annotateError(&resp, id)
+	sp.SetAttribute("request.id", id)
+	sp.SetAttribute("volume.name", req.Name)
 	logctx := log.WithFields(log.Fields{
 		"operation": "mount",
 		"name":      req.Name,
+		"requestID": id,
 	})
+
+	if err := validateVolumeName(req.Name); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
 	logctx.Debug("request accepted")
 
-	path := v.pathForVolume(req.Name)
-	if err := os.MkdirAll(path, 0700); err != nil {
-		resp.Err = fmt.Sprintf("could not create mount point: %v", err)
+	path, err := v.pathForVolume(req.Name)
+	if err != nil {
+		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
 	}
 
-	meta, err := v.meta.Get(req.Name)
+	meta, err := v.meta.Get(logctx, req.Name)
 	if err != nil {
 		resp.Err = fmt.Sprintf("could not fetch metadata: %v", err)
 		logctx.Error(resp.Err)
@@ -139,10 +349,33 @@ func (v *volumeDriver) Mount(req volume.MountRequest) (resp volume.Response) {
 		logctx.Error(resp.Err)
 		return
 	}
+	if err := checkStoredOptions(meta.Options); err != nil {
+		resp.Err = fmt.Sprintf("mount failed: %v", err)
+		logctx.Error(resp.Err)
+		return
+	}
 
-	if err := mount(v.accountName, v.accountKey, v.storageBase, path, meta.Options); err != nil {
+	if err := os.MkdirAll(path, 0700); err != nil {
+		resp.Err = fmt.Sprintf("could not create mount point: %v", err)
+		logctx.Error(resp.Err)
+		return
+	}
+
+	msp := startSpan(sp, "mount.cifs")
+	msp.SetAttribute("share", meta.Options.Share)
+	err = mount(logctx, v.accountName, v.accountKey, v.smbHost, path, meta.Options, v.mountTimeout)
+	msp.FinishErr(err)
+	if err != nil {
 		resp.Err = err.Error()
 		logctx.Error(resp.Err)
+
+		// do not leave an unused mountpoint behind, unless an earlier mount
+		// of the volume is still active on it
+		if active, err := isMounted(logctx, path); err == nil && !active {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				logctx.Warnf("could not remove mountpoint: %v", err)
+			}
+		}
 		return
 	}
 	resp.Mountpoint = path
@@ -150,17 +383,38 @@ func (v *volumeDriver) Mount(req volume.MountRequest) (resp volume.Response) {
 }
 
 func (v *volumeDriver) Unmount(req volume.UnmountRequest) (resp volume.Response) {
-	v.m.Lock()
+	sp := startSpan(nil, "VolumeDriver.Unmount")
+	defer func() { sp.Finish(resp.Err) }()
+	v.lock(sp)
 	defer v.m.Unlock()
 
+	id := newRequestID(req.ID)
+	defer annotateError(&resp, id)
+	sp.SetAttribute("request.id", id)
+	sp.SetAttribute("volume.name", req.Name)
 	logctx := log.WithFields(log.Fields{
 		"operation": "unmount",
 		"name":      req.Name,
+		"requestID": id,
 	})
 
+	if err := validateVolumeName(req.Name); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
+
 	logctx.Debug("request accepted")
-	path := v.pathForVolume(req.Name)
-	if err := unmount(path); err != nil {
+	path, err := v.pathForVolume(req.Name)
+	if err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
+	usp := startSpan(sp, "umount")
+	err = unmount(path)
+	usp.FinishErr(err)
+	if err != nil {
 		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
@@ -179,7 +433,7 @@ func (v *volumeDriver) Unmount(req volume.UnmountRequest) (resp volume.Response)
 	//
 	// In that case, we read the mount table to see if there is still something
 	// mounted, and only when there is nothing mounted, we remove the mountpoint
-	isActive, err := isMounted(path)
+	isActive, err := isMounted(logctx, path)
 	if err != nil {
 		resp.Err = err.Error()
 		logctx.Error(resp.Err)
@@ -199,37 +453,49 @@ func (v *volumeDriver) Unmount(req volume.UnmountRequest) (resp volume.Response)
 }
 
 func (v *volumeDriver) Remove(req volume.Request) (resp volume.Response) {
-	v.m.Lock()
+	sp := startSpan(nil, "VolumeDriver.Remove")
+	defer func() { sp.Finish(resp.Err) }()
+	v.lock(sp)
 	defer v.m.Unlock()
 
+	id := newRequestID("")
+	defer annotateError(&resp, id)
+	sp.SetAttribute("request.id", id)
+	sp.SetAttribute("volume.name", req.Name)
 	logctx := log.WithFields(log.Fields{
 		"operation": "remove",
 		"name":      req.Name,
+		"requestID": id,
 	})
+
+	if err := validateVolumeName(req.Name); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
 	logctx.Debug("request accepted")
 
-	meta, err := v.meta.Get(req.Name)
-	if err != nil {
+	meta, err := v.meta.Get(logctx, req.Name)
+	if err == errVolumeNotFound {
+		// nothing left to clean up, e.g. metadata was quarantined
+		logctx.Warn("no metadata found for volume, nothing to remove")
+		return
+	} else if err != nil {
 		resp.Err = fmt.Sprintf("could not fetch metadata: %v", err)
 		logctx.Error(resp.Err)
 		return
 	}
 
-	share := meta.Options.Share
-	if v.removeShares {
-		if ok, err := v.cl.DeleteShareIfExists(share); err != nil {
-			resp.Err = fmt.Sprintf("error removing azure file share %q: %v", share, err)
-			logctx.Error(resp.Err)
-			return
-		} else if ok {
-			logctx.Infof("removed azure file share %q", share)
-		}
-	} else {
-		logctx.Debugf("not removing share %q upon volume removal", share)
+	policy := v.removePolicy(meta.Options)
+	logctx.Debugf("applying removal policy %q", policy)
+	if err := v.removeData(logctx, v.files.withRequest(id, sp), req.Name, meta.Options, policy); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
 	}
 
 	logctx.Debug("removing volume metadata")
-	if err != v.meta.Delete(req.Name) {
+	if err := v.meta.Delete(req.Name); err != nil {
 		resp.Err = err.Error()
 		logctx.Error(resp.Err)
 		return
@@ -237,35 +503,257 @@ func (v *volumeDriver) Remove(req volume.Request) (resp volume.Response) {
 	return
 }
 
-func (v *volumeDriver) Get(req volume.Request) (resp volume.Response) {
-	v.m.Lock()
+// removePolicy returns the removal policy for a volume: the one set with the
+// 'removepolicy' volume option, or the daemon-wide default.
+func (v *volumeDriver) removePolicy(opts VolumeOptions) string {
+	if opts.RemovePolicy != "" {
+		return opts.RemovePolicy
+	}
+	if (opts.Subdir && v.removeSubdirs) || (!opts.Subdir && v.removeShares) {
+		return removePolicyDelete
+	}
+	return removePolicyRetain
+}
+
+// removeData applies the removal policy to the data of a volume being
+// removed. For subdirectory volumes only the volume directory is affected as
+// the share is shared with other volumes.
+//
+// Data still used by other volumes is left in place, and data mounted
+// anywhere on the host is never removed.
+func (v *volumeDriver) removeData(logctx *log.Entry, files *fileAPI, name string, opts VolumeOptions, policy string) error {
+	share := opts.Share
+	if policy == removePolicyRetain {
+		if opts.Subdir {
+			logctx.Debugf("not removing directory %q upon volume removal", opts.RemotePath)
+		} else {
+			logctx.Debugf("not removing share %q upon volume removal", share)
+		}
+		return nil
+	}
+
+	if opts.Subdir && opts.RemotePath == "" {
+		// never treat the whole share as the volume directory
+		return fmt.Errorf("refusing to remove data of subdirectory volume without 'remotepath' on share %q", share)
+	}
+
+	refs, err := v.dataReferences(logctx, name, opts)
+	if err != nil {
+		return fmt.Errorf("cannot check other volumes using the data: %v", err)
+	}
+	if len(refs) > 0 {
+		logctx.Warnf("not removing data upon volume removal, still used by volumes %v", refs)
+		return nil
+	}
+
+	uri := remoteURI(v.smbHost, share, "")
+	if opts.Subdir {
+		uri = remoteURI(v.smbHost, share, opts.RemotePath)
+	}
+	mounts, err := cifsMountpoints(uri)
+	if err != nil {
+		return err
+	}
+	if len(mounts) > 0 {
+		return fmt.Errorf("refusing to remove data of %s, it is mounted at %v", uri, mounts)
+	}
+
+	if policy == removePolicySnapshot {
+		snapshot, err := files.SnapshotShare(share)
+		if err != nil {
+			return fmt.Errorf("error taking snapshot of azure file share %q: %v", share, err)
+		}
+		logctx.Infof("took snapshot %q of azure file share %q", snapshot, share)
+	}
+
+	if opts.Subdir {
+		if err := files.DeleteDirectoryAll(share, opts.RemotePath); err != nil {
+			return fmt.Errorf("error removing directory %q from azure file share %q: %v", opts.RemotePath, share, err)
+		}
+		v.usage.forget(share, opts.RemotePath)
+		logctx.Infof("removed directory %q from azure file share %q", opts.RemotePath, share)
+		return nil
+	}
+
+	if policy == removePolicySnapshot {
+		// A share cannot be deleted while it has snapshots, so the share is
+		// emptied instead and kept along with the snapshot.
+		if err := files.DeleteDirectoryContents(share, ""); err != nil {
+			return fmt.Errorf("error removing contents of azure file share %q: %v", share, err)
+		}
+		logctx.Infof("removed contents of azure file share %q, share is kept with its snapshot", share)
+		return nil
+	}
+
+	if ok, err := files.DeleteShareIfExists(share); err != nil {
+		return fmt.Errorf("error removing azure file share %q: %v", share, err)
+	} else if ok {
+		logctx.Infof("removed azure file share %q", share)
+	}
+	return nil
+}
+
+// dataReferences returns the volumes other than the named one whose data
+// would be lost by removing the data of a volume with the specified options:
+// all volumes on the same share, or for subdirectory volumes, those in or
+// under the volume directory.
+func (v *volumeDriver) dataReferences(logctx *log.Entry, name string, opts VolumeOptions) ([]string, error) {
+	vols, err := v.meta.References(logctx, opts.Share)
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, vn := range vols {
+		if vn == name {
+			continue
+		}
+		if opts.Subdir {
+			other, err := v.meta.Get(logctx, vn)
+			if err != nil {
+				return nil, err
+			}
+			if !isSubpath(other.Options.RemotePath, opts.RemotePath) {
+				continue
+			}
+		}
+		refs = append(refs, vn)
+	}
+	return refs, nil
+}
+
+// readMetadata reads the metadata of a volume under the driver lock.
+func (v *volumeDriver) readMetadata(logctx *log.Entry, sp *span, name string) (volumeMetadata, error) {
+	v.lock(sp)
 	defer v.m.Unlock()
+	return v.meta.Get(logctx, name)
+}
+
+// lock takes the driver lock, tracing the time spent waiting for the
+// operation in progress.
+func (v *volumeDriver) lock(parent *span) {
+	sp := startSpan(parent, "driver lock")
+	v.m.Lock()
+	sp.Finish("")
+}
+
+// newRequestID returns the ID correlating the log entries, Azure API calls
+// and errors of a plugin request: id if it is not empty, such as the caller
+// ID of mount requests, or a new random ID.
+func newRequestID(id string) string {
+	if id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
+
+// annotateError adds the request ID to the error of a failed response.
+func annotateError(resp *volume.Response, id string) {
+	if resp.Err != "" {
+		resp.Err = fmt.Sprintf("%s (request %s)", resp.Err, id)
+	}
+}
+
+// checkHealth reports whether the driver is able to serve requests. It does
+// not take the driver lock, since long volume operations are not a failure.
+func (v *volumeDriver) checkHealth() error {
+	if _, err := ioutil.ReadDir(v.meta.metaDir); err != nil {
+		return fmt.Errorf("cannot read metadata directory: %v", err)
+	}
+	if _, err := os.Stat(v.mountpoint); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot access mountpoint directory: %v", err)
+	}
+	return nil
+}
+
+// isSubpath reports whether p is dir or a path under dir. Every path is under
+// the empty dir, the root of the share.
+func isSubpath(p, dir string) bool {
+	p, dir = strings.Trim(p, "/"), strings.Trim(dir, "/")
+	return dir == "" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// Get reports the volume and its status. Unlike the other requests it only
+// holds the driver lock while reading the metadata: docker calls Get on every
+// container start, and computing the usage of a subdirectory volume walks the
+// whole directory tree, which must not hold up mounts of other volumes. The
+// usage is cached for usageCacheTTL so that the walk is not repeated for
+// every container.
+func (v *volumeDriver) Get(req volume.Request) (resp volume.Response) {
+	sp := startSpan(nil, "VolumeDriver.Get")
+	defer func() { sp.Finish(resp.Err) }()
+
+	id := newRequestID("")
+	defer annotateError(&resp, id)
+	sp.SetAttribute("request.id", id)
+	sp.SetAttribute("volume.name", req.Name)
 	logctx := log.WithFields(log.Fields{
 		"operation": "get",
 		"name":      req.Name,
+		"requestID": id,
 	})
+
+	if err := validateVolumeName(req.Name); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
 	logctx.Debug("request accepted")
 
-	_, err := v.meta.Get(req.Name)
+	meta, err := v.readMetadata(logctx, sp, req.Name)
 	if err != nil {
 		resp.Err = fmt.Sprintf("could not fetch metadata: %v", err)
 		logctx.Error(resp.Err)
 		return
 	}
-	resp.Volume = v.volumeEntry(req.Name)
+	if resp.Volume, err = v.volumeEntry(req.Name); err != nil {
+		resp.Err = err.Error()
+		logctx.Error(resp.Err)
+		return
+	}
+
+	status := make(map[string]interface{})
+	if meta.Options.Subdir {
+		status["share"] = meta.Options.Share
+		status["remotepath"] = meta.Options.RemotePath
+		files, bytes, err := v.usage.get(meta.Options.Share, meta.Options.RemotePath, func() (int, int64, error) {
+			return v.files.withRequest(id, sp).DirectoryUsage(meta.Options.Share, meta.Options.RemotePath)
+		})
+		if err != nil {
+			logctx.Warnf("cannot determine directory usage: %v", err)
+		} else {
+			status["files"] = files
+			status["bytes"] = bytes
+		}
+	}
+	if len(meta.Labels) > 0 {
+		status["labels"] = meta.Labels
+	}
+	if len(status) > 0 {
+		resp.Volume.Status = status
+	}
 	return
 }
 
 func (v *volumeDriver) List(req volume.Request) (resp volume.Response) {
-	v.m.Lock()
+	sp := startSpan(nil, "VolumeDriver.List")
+	defer func() { sp.Finish(resp.Err) }()
+	v.lock(sp)
 	defer v.m.Unlock()
 
+	id := newRequestID("")
+	defer annotateError(&resp, id)
+	sp.SetAttribute("request.id", id)
 	logctx := log.WithFields(log.Fields{
 		"operation": "list",
+		"requestID": id,
 	})
 	logctx.Debug("request accepted")
 
-	vols, err := v.meta.List()
+	vols, err := v.meta.List(logctx)
 	if err != nil {
 		resp.Err = fmt.Sprintf("failed to list managed volumes: %v", err)
 		logctx.Error(resp.Err)
@@ -273,65 +761,152 @@ func (v *volumeDriver) List(req volume.Request) (resp volume.Response) {
 	}
 
 	for _, vn := range vols {
-		resp.Volumes = append(resp.Volumes, v.volumeEntry(vn))
+		vol, err := v.volumeEntry(vn)
+		if err != nil {
+			logctx.Warnf("leaving out volume: %v", err)
+			continue
+		}
+		resp.Volumes = append(resp.Volumes, vol)
 	}
 	logctx.Debugf("response has %d items", len(resp.Volumes))
 	return
 }
 
-func (v *volumeDriver) volumeEntry(name string) *volume.Volume {
-	return &volume.Volume{Name: name,
-		Mountpoint: v.pathForVolume(name)}
-}
-
-func (v *volumeDriver) pathForVolume(name string) string {
-	return filepath.Join(v.mountpoint, name)
-}
-
-func mount(accountName, accountKey, storageBase, mountPath string, options VolumeOptions) error {
-	// Set defaults
-	if len(options.FileMode) == 0 {
-		options.FileMode = "0777"
+// removeCreatedShare deletes a share created for a volume that could not be
+// created, unless other volumes refer to it.
+func (v *volumeDriver) removeCreatedShare(logctx *log.Entry, files *fileAPI, name, share string) {
+	refs, err := v.meta.References(logctx, share)
+	if err != nil {
+		logctx.Warnf("not removing azure file share %q created for the volume: %v", share, err)
+		return
 	}
-	if len(options.DirMode) == 0 {
-		options.DirMode = "0777"
+	for _, r := range refs {
+		if r != name {
+			logctx.Warnf("not removing azure file share %q created for the volume, used by volumes %v", share, refs)
+			return
+		}
 	}
-	if len(options.UID) == 0 {
-		options.UID = "0"
+	if _, err := files.DeleteShareIfExists(share); err != nil {
+		logctx.Warnf("cannot remove azure file share %q created for the volume: %v", share, err)
+		return
 	}
-	if len(options.GID) == 0 {
-		options.GID = "0"
+	logctx.Infof("removed azure file share %q created for the volume", share)
+}
+
+// createGeneratedShare creates a new Azure File share with a name generated
+// from the volume name. Names already used by other volumes or by existing
+// shares in the account are skipped.
+func (v *volumeDriver) createGeneratedShare(logctx *log.Entry, files *fileAPI, volumeName string) (string, error) {
+	for attempt := 0; attempt < maxShareNameAttempts; attempt++ {
+		share, err := v.namer.Name(volumeName, attempt)
+		if err != nil {
+			return "", fmt.Errorf("cannot generate share name: %v", err)
+		}
+		refs, err := v.meta.References(logctx, share)
+		if err != nil {
+			return "", fmt.Errorf("cannot check share name collisions: %v", err)
+		}
+		if len(refs) > 0 {
+			logctx.Debugf("generated share name %q is used by volumes %v", share, refs)
+			continue
+		}
+		if err := v.policy.checkShare(share); err != nil {
+			return "", err
+		}
+		if err := files.CreateShare(share); err != nil {
+			if isStatus(err, http.StatusConflict) {
+				logctx.Debugf("generated share name %q already exists in the account", share)
+				continue
+			}
+			return "", fmt.Errorf("error creating azure file share: %v", err)
+		}
+		return share, nil
 	}
-	mountURI := fmt.Sprintf("//%s.file.%s/%s", accountName, storageBase, options.Share)
-	if len(options.RemotePath) != 0 {
-		mountURI += fmt.Sprintf("/%s", strings.TrimPrefix(options.RemotePath, "/"))
+	return "", fmt.Errorf("could not find an unused share name for volume %q after %d attempts", volumeName, maxShareNameAttempts)
+}
+
+func (v *volumeDriver) volumeEntry(name string) (*volume.Volume, error) {
+	path, err := v.pathForVolume(name)
+	if err != nil {
+		return nil, err
 	}
+	return &volume.Volume{Name: name, Mountpoint: path}, nil
+}
+
+func (v *volumeDriver) pathForVolume(name string) (string, error) {
+	return volumePath(v.mountpoint, name)
+}
+
+// mount mounts the volume at mountPath from the SMB server host using the
+// mount.cifs helper. If timeout is non-zero and the helper does not finish in
+// time, for instance because outbound SMB traffic is filtered, it is killed
+// and an error is returned.
+func mount(logctx *log.Entry, accountName, accountKey, host, mountPath string, options VolumeOptions, timeout time.Duration) error {
+	mountURI := remoteURI(host, options.Share, options.RemotePath)
 
-	opts := []string{
-		"vers=3.0",
+	opts := append(cifsMountOptions(options),
 		fmt.Sprintf("username=%s", accountName),
 		fmt.Sprintf("password=%s", accountKey),
-		fmt.Sprintf("file_mode=%s", options.FileMode),
-		fmt.Sprintf("dir_mode=%s", options.DirMode),
-		fmt.Sprintf("uid=%s", options.UID),
-		fmt.Sprintf("gid=%s", options.GID),
-	}
-	if options.NoLock {
-		opts = append(opts, "nolock")
-	}
+	)
 
 	// TODO: replace with mount() syscall using docker/docker/pkg/mount
 	// (currently gives hard-to-debug 'invalid argument' error with the
 	// following arguments, my guess is, mount program does IP resolution
 	// and essentially passes a different set of options to system call).
 	cmd := exec.Command("mount", "-t", "cifs", mountURI, mountPath, "-o", strings.Join(opts, ","), "--verbose")
-	out, err := cmd.CombinedOutput()
-	if err != nil {
+	out, err := runWithTimeout(logctx, cmd, timeout)
+	if err == errTimeout {
+		return fmt.Errorf("mount failed: timed out connecting to %s:445 after %v", host, timeout)
+	} else if err != nil {
 		return fmt.Errorf("mount failed: %v\noutput=%q", err, out)
 	}
 	return nil
 }
 
+var errTimeout = errors.New("timed out")
+
+// runWithTimeout runs cmd and returns its combined output. If timeout is
+// non-zero and cmd does not exit in time, its process group (mount runs
+// mount.cifs as a child) is killed and errTimeout is returned.
+func runWithTimeout(logctx *log.Entry, cmd *exec.Cmd, timeout time.Duration) ([]byte, error) {
+	if timeout == 0 {
+		return cmd.CombinedOutput()
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return out.Bytes(), err
+	case <-time.After(timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			// stuck in the kernel, let it go
+			logctx.Warnf("process %d did not exit after being killed", cmd.Process.Pid)
+		}
+		return nil, errTimeout
+	}
+}
+
+// remoteURI returns the UNC path of the share on the SMB server host, or of
+// a directory in the share, as it is passed to and reported by mount.cifs.
+func remoteURI(host, share, remotePath string) string {
+	uri := fmt.Sprintf("//%s/%s", host, share)
+	if len(remotePath) != 0 {
+		uri += fmt.Sprintf("/%s", strings.TrimPrefix(remotePath, "/"))
+	}
+	return uri
+}
+
 func unmount(mountpoint string) error {
 	cmd := exec.Command("umount", mountpoint)
 	out, err := cmd.CombinedOutput()
@@ -343,7 +918,7 @@ func unmount(mountpoint string) error {
 
 // isMounted reads /proc/self/mountinfo to see if the specified mountpoint is
 // mounted.
-func isMounted(mountpoint string) (bool, error) {
+func isMounted(logctx *log.Entry, mountpoint string) (bool, error) {
 	f, err := os.Open("/proc/self/mountinfo")
 	if err != nil {
 		return false, fmt.Errorf("cannot read mountinfo: %v", err)
@@ -374,7 +949,7 @@ func isMounted(mountpoint string) (bool, error) {
 		if len(f) < 5 {
 			return false, fmt.Errorf("mountinfo line %q has less than 5 fields, cannot parse mountpoint", t)
 		}
-		mp := f[4] // ID, Parent, Major, Minor, Root, *Mountpoint*, Opts, OptionalFields
+		mp := unescapeMountinfo(f[4]) // ID, Parent, Major, Minor, Root, *Mountpoint*, Opts, OptionalFields
 		fi, err := os.Stat(mp)
 		if err != nil {
 			return false, fmt.Errorf("cannot stat %s: %v", mp, err)
@@ -384,6 +959,65 @@ func isMounted(mountpoint string) (bool, error) {
 			return true, nil
 		}
 	}
-	log.Debug("mountpoint not found")
+	logctx.Debug("mountpoint not found")
 	return false, nil
 }
+
+// cifsMountpoints reads /proc/self/mountinfo and returns the mountpoints of
+// the cifs mounts of the specified remote URI or of paths under it.
+func cifsMountpoints(uri string) ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read mountinfo: %v", err)
+	}
+	defer f.Close()
+	return parseCifsMountpoints(f, uri)
+}
+
+// parseCifsMountpoints returns the mountpoints of the cifs mounts of uri, or
+// of paths under it, listed in mountinfo format by r.
+func parseCifsMountpoints(r io.Reader, uri string) ([]string, error) {
+	// The filesystem type and the mount source follow the '-' separator
+	// after the optional fields (see isMounted for the format).
+	var mounts []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		for i := 6; i+2 < len(fields); i++ {
+			if fields[i] != "-" {
+				continue
+			}
+			fstype, source := fields[i+1], unescapeMountinfo(fields[i+2])
+			if fstype == "cifs" && isSubpath(strings.ToLower(source), strings.ToLower(uri)) {
+				mounts = append(mounts, unescapeMountinfo(fields[4]))
+			}
+			break
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read mountinfo: %v", err)
+	}
+	return mounts, nil
+}
+
+// unescapeMountinfo decodes a mountinfo field, in which the kernel escapes
+// space, tab, newline and backslash as octal sequences such as \040.
+func unescapeMountinfo(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && isOctal(s[i+1]) && isOctal(s[i+2]) && isOctal(s[i+3]) {
+			b = append(b, (s[i+1]-'0')<<6|(s[i+2]-'0')<<3|(s[i+3]-'0'))
+			i += 3
+			continue
+		}
+		b = append(b, s[i])
+	}
+	return string(b)
+}
+
+func isOctal(c byte) bool {
+	return c >= '0' && c <= '7'
+}
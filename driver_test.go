@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestUnescapeMountinfo(t *testing.T) {
+	cases := map[string]string{
+		"/mnt/plain":        "/mnt/plain",
+		`/mnt/my\040volume`: "/mnt/my volume",
+		`//acct.file/share/a\040b\011c\012d\134e`: "//acct.file/share/a b\tc\nd\\e",
+		`/mnt/trailing\04`:                        `/mnt/trailing\04`,
+		`/mnt/not\08octal`:                        `/mnt/not\08octal`,
+	}
+	for in, want := range cases {
+		if got := unescapeMountinfo(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestParseCifsMountpoints(t *testing.T) {
+	mountinfo := strings.Join([]string{
+		`22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw`,
+		`40 22 0:40 / /mnt/vols/share1 rw,relatime shared:20 - cifs //acct.file.core.windows.net/share1 rw,vers=3.0`,
+		`41 22 0:41 / /mnt/vols/my\040vol rw,relatime - cifs //acct.file.core.windows.net/shared/my\040dir rw,vers=3.0`,
+		`42 22 0:42 / /mnt/vols/nested rw,relatime - cifs //ACCT.file.core.windows.net/shared/my\040dir/sub rw`,
+		`43 22 0:43 / /mnt/vols/other rw,relatime - cifs //acct.file.core.windows.net/shared/my\040dirx rw`,
+		`44 22 0:44 / /mnt/nfs rw,relatime - nfs4 server:/shared/my\040dir rw`,
+	}, "\n")
+
+	cases := []struct {
+		uri  string
+		want []string
+	}{
+		{"//acct.file.core.windows.net/share1", []string{"/mnt/vols/share1"}},
+		{"//acct.file.core.windows.net/shared/my dir", []string{"/mnt/vols/my vol", "/mnt/vols/nested"}},
+		{"//acct.file.core.windows.net/shared", []string{"/mnt/vols/my vol", "/mnt/vols/nested", "/mnt/vols/other"}},
+		{"//acct.file.core.windows.net/share2", nil},
+	}
+	for _, c := range cases {
+		got, err := parseCifsMountpoints(strings.NewReader(mountinfo), c.uri)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %q, want %q", c.uri, got, c.want)
+		}
+	}
+}
+
+func TestIsSubpath(t *testing.T) {
+	cases := []struct {
+		p, dir string
+		want   bool
+	}{
+		{"vol1", "vol1", true},
+		{"vols/vol1", "vols", true},
+		{"/vols/vol1/", "vols/", true},
+		{"vols1", "vols", false},
+		{"vols", "vols/vol1", false},
+		{"vol1", "", true},
+		{"", "", true},
+	}
+	for _, c := range cases {
+		if got := isSubpath(c.p, c.dir); got != c.want {
+			t.Errorf("isSubpath(%q, %q) = %v, want %v", c.p, c.dir, got, c.want)
+		}
+	}
+}
+
+// fakeShareService serves share creation, deletion, properties and metadata
+// requests for a set of existing shares with their quotas.
+type fakeShareService struct {
+	mu        sync.Mutex
+	quotas    map[string]int  // existing shares
+	set       map[string]int  // quotas set by the driver
+	failQuota map[string]bool // shares whose quota cannot be set
+}
+
+func (s *fakeShareService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	share := path.Base(r.URL.Path)
+	switch q := r.URL.Query(); {
+	case r.Method == "GET" && q.Get("restype") == "share":
+		w.Header().Set("x-ms-share-quota", strconv.Itoa(s.quotas[share]))
+	case q.Get("comp") == "properties":
+		if s.failQuota[share] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		n, _ := strconv.Atoi(r.Header.Get("x-ms-share-quota"))
+		s.set[share] = n
+	case q.Get("comp") == "metadata":
+	case r.Method == "PUT" && q.Get("restype") == "share":
+		if _, ok := s.quotas[share]; ok {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		s.quotas[share] = maxShareQuota
+		w.WriteHeader(http.StatusCreated)
+	case r.Method == "DELETE" && q.Get("restype") == "share":
+		delete(s.quotas, share)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// testVolumeDriver returns a driver using the File Service served by h and
+// a temporary metadata directory.
+func testVolumeDriver(t *testing.T, h http.Handler) (*volumeDriver, func()) {
+	srv := httptest.NewServer(h)
+	m, cleanup := testMetadataDriver(t)
+	d, err := newVolumeDriver(driverConfig{
+		AccountName:       "devstoreaccount1",
+		AccountKey:        devstoreKey,
+		FileEndpoint:      srv.URL + "/devstoreaccount1",
+		MetadataRoot:      m.metaDir,
+		ShareNameTemplate: defaultShareNameTemplate,
+	})
+	if err != nil {
+		srv.Close()
+		cleanup()
+		t.Fatal(err)
+	}
+	return d, func() { srv.Close(); cleanup() }
+}
+
+func TestCreateQuota(t *testing.T) {
+	svc := &fakeShareService{
+		quotas: map[string]int{"prodshare": maxShareQuota, "smallshare": 50},
+		set:    map[string]int{},
+	}
+	d, cleanup := testVolumeDriver(t, svc)
+	defer cleanup()
+
+	cases := []struct {
+		share string
+		err   string
+		set   bool
+	}{
+		{share: "newshare", set: true},
+		{share: "prodshare", err: "already exists with a quota of 5120 GiB, larger than the requested 100 GiB"},
+		{share: "smallshare"},
+	}
+	for _, c := range cases {
+		resp := d.Create(volume.Request{Name: "vol-" + c.share, Options: map[string]string{"share": c.share, "quota": "100"}})
+		if (c.err == "" && resp.Err != "") || !strings.Contains(resp.Err, c.err) {
+			t.Errorf("%s: got error %q, want %q", c.share, resp.Err, c.err)
+		}
+		if _, set := svc.set[c.share]; set != c.set {
+			t.Errorf("%s: quota set: %v, want %v", c.share, set, c.set)
+		}
+	}
+	if svc.set["newshare"] != 100 {
+		t.Errorf("got quota %d for the new share, want 100", svc.set["newshare"])
+	}
+}
+
+func TestCreateRemovesShareOnFailure(t *testing.T) {
+	svc := &fakeShareService{
+		quotas:    map[string]int{"oldshare": 50},
+		set:       map[string]int{},
+		failQuota: map[string]bool{"newshare": true, "oldshare": true},
+	}
+	d, cleanup := testVolumeDriver(t, svc)
+	defer cleanup()
+
+	resp := d.Create(volume.Request{Name: "vol1", Options: map[string]string{"share": "newshare", "quota": "100"}})
+	if !strings.Contains(resp.Err, "error setting quota") {
+		t.Fatalf("got error %q, want quota error", resp.Err)
+	}
+	if _, ok := svc.quotas["newshare"]; ok {
+		t.Error("share created for the failed volume was not removed")
+	}
+
+	// creating the volume directory fails, the fake serves no directories
+	if err := d.meta.Set("vol2", volumeMetadata{Options: VolumeOptions{Share: "refshare", Subdir: true, RemotePath: "vol2"}}); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		share string
+		kept  bool
+	}{
+		{"subdirshare", false},
+		{"oldshare", true}, // existed before
+		{"refshare", true}, // used by another volume
+	}
+	for _, c := range cases {
+		resp := d.Create(volume.Request{Name: "vol-" + c.share, Options: map[string]string{"share": c.share, "subdir": "true"}})
+		if !strings.Contains(resp.Err, "error creating volume directory") {
+			t.Errorf("%s: got error %q, want directory error", c.share, resp.Err)
+		}
+		if _, ok := svc.quotas[c.share]; ok != c.kept {
+			t.Errorf("%s: share kept: %v, want %v", c.share, ok, c.kept)
+		}
+	}
+}
+
+// fakeShareTree serves an in-memory tree of shares, directories and files.
+// Paths are "share/dir/file"; a share is also its root directory.
+type fakeShareTree struct {
+	mu        sync.Mutex
+	dirs      map[string]bool
+	files     map[string]string
+	snapshots map[string]int
+}
+
+func newFakeShareTree(paths ...string) *fakeShareTree {
+	s := &fakeShareTree{dirs: map[string]bool{}, files: map[string]string{}, snapshots: map[string]int{}}
+	for _, p := range paths {
+		if strings.HasSuffix(p, "/") {
+			s.mkdirAll(strings.TrimSuffix(p, "/"))
+			continue
+		}
+		s.mkdirAll(path.Dir(p))
+		s.files[p] = "content of " + path.Base(p)
+	}
+	return s
+}
+
+func (s *fakeShareTree) mkdirAll(p string) {
+	for ; p != "."; p = path.Dir(p) {
+		s.dirs[p] = true
+	}
+}
+
+// children returns the names of the directories and files directly in dir.
+func (s *fakeShareTree) children(dir string) (dirs, files []string) {
+	for d := range s.dirs {
+		if path.Dir(d) == dir {
+			dirs = append(dirs, path.Base(d))
+		}
+	}
+	for f := range s.files {
+		if path.Dir(f) == dir {
+			files = append(files, path.Base(f))
+		}
+	}
+	sort.Strings(dirs)
+	sort.Strings(files)
+	return dirs, files
+}
+
+func (s *fakeShareTree) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/devstoreaccount1"), "/")
+	share := strings.SplitN(p, "/", 2)[0]
+	q := r.URL.Query()
+	mtime := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	switch {
+	case r.Method == "PUT" && q.Get("restype") == "share" && q.Get("comp") == "snapshot":
+		s.snapshots[share]++
+		w.Header().Set("x-ms-snapshot", "2026-10-19T10:00:00.0000000Z")
+	case r.Method == "DELETE" && q.Get("restype") == "share":
+		if !s.dirs[share] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if s.snapshots[share] > 0 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		for d := range s.dirs {
+			if d == share || strings.HasPrefix(d, share+"/") {
+				delete(s.dirs, d)
+			}
+		}
+		for f := range s.files {
+			if strings.HasPrefix(f, share+"/") {
+				delete(s.files, f)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "GET" && q.Get("restype") == "directory" && q.Get("comp") == "list":
+		if !s.dirs[p] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		dirs, files := s.children(p)
+		fmt.Fprint(w, "<EnumerationResults><Entries>")
+		for _, d := range dirs {
+			fmt.Fprintf(w, "<Directory><Name>%s</Name></Directory>", d)
+		}
+		for _, f := range files {
+			fmt.Fprintf(w, "<File><Name>%s</Name><Properties><Content-Length>%d</Content-Length></Properties></File>",
+				f, len(s.files[path.Join(p, f)]))
+		}
+		fmt.Fprint(w, "</Entries><NextMarker /></EnumerationResults>")
+	case r.Method == "GET" && q.Get("restype") == "directory":
+		if !s.dirs[p] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", mtime)
+	case r.Method == "DELETE" && q.Get("restype") == "directory":
+		if dirs, files := s.children(p); len(dirs)+len(files) > 0 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		delete(s.dirs, p)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "DELETE":
+		delete(s.files, p)
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "GET":
+		content, ok := s.files[p]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", mtime)
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		io.WriteString(w, content)
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+// paths returns the directories (with a trailing slash) and files in the
+// tree.
+func (s *fakeShareTree) paths() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var paths []string
+	for d := range s.dirs {
+		paths = append(paths, d+"/")
+	}
+	for f := range s.files {
+		paths = append(paths, f)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestRemovePolicies(t *testing.T) {
+	cases := []struct {
+		name      string
+		options   VolumeOptions
+		snapshots int
+		want      []string // what is left of the share
+	}{
+		{"retain", VolumeOptions{Share: "vol", RemovePolicy: removePolicyRetain}, 0,
+			[]string{"vol/", "vol/a/", "vol/a/f2", "vol/f1"}},
+		{"delete", VolumeOptions{Share: "vol", RemovePolicy: removePolicyDelete}, 0,
+			nil},
+		{"snapshot share", VolumeOptions{Share: "vol", RemovePolicy: removePolicySnapshot}, 1,
+			[]string{"vol/"}},
+		{"delete subdir", VolumeOptions{Share: "shared", Subdir: true, RemotePath: "vols/v1", RemovePolicy: removePolicyDelete}, 0,
+			[]string{"shared/", "shared/vols/", "shared/vols/v10/", "shared/vols/v10/f", "shared/vols/v2/", "shared/vols/v2/f"}},
+		{"snapshot subdir", VolumeOptions{Share: "shared", Subdir: true, RemotePath: "vols/v1", RemovePolicy: removePolicySnapshot}, 1,
+			[]string{"shared/", "shared/vols/", "shared/vols/v10/", "shared/vols/v10/f", "shared/vols/v2/", "shared/vols/v2/f"}},
+		{"retain subdir", VolumeOptions{Share: "shared", Subdir: true, RemotePath: "vols/v1"}, 0,
+			[]string{"shared/", "shared/vols/", "shared/vols/v1/", "shared/vols/v1/sub/", "shared/vols/v1/sub/f",
+				"shared/vols/v10/", "shared/vols/v10/f", "shared/vols/v2/", "shared/vols/v2/f"}},
+	}
+	for _, c := range cases {
+		tree := newFakeShareTree("vol/f1", "vol/a/f2",
+			"shared/vols/v1/sub/f", "shared/vols/v10/f", "shared/vols/v2/f")
+		d, cleanup := testVolumeDriver(t, tree)
+		if err := d.meta.Set("v1", volumeMetadata{Account: "devstoreaccount1", Options: c.options}); err != nil {
+			t.Fatal(err)
+		}
+
+		if resp := d.Remove(volume.Request{Name: "v1"}); resp.Err != "" {
+			t.Errorf("%s: %s", c.name, resp.Err)
+		}
+		if ok, _ := d.meta.Exists("v1"); ok {
+			t.Errorf("%s: metadata not removed", c.name)
+		}
+		if n := tree.snapshots[c.options.Share]; n != c.snapshots {
+			t.Errorf("%s: got %d snapshots, want %d", c.name, n, c.snapshots)
+		}
+		var left []string
+		for _, p := range tree.paths() {
+			if strings.HasPrefix(p, c.options.Share+"/") {
+				left = append(left, p)
+			}
+		}
+		if !reflect.DeepEqual(left, c.want) {
+			t.Errorf("%s: got %q left, want %q", c.name, left, c.want)
+		}
+		cleanup()
+	}
+}
+
+func TestRemoveKeepsDataOfOtherVolumes(t *testing.T) {
+	tree := newFakeShareTree("vol/f", "shared/vols/v1/sub/f")
+	d, cleanup := testVolumeDriver(t, tree)
+	defer cleanup()
+	d.removeShares, d.removeSubdirs = true, true
+
+	records := map[string]VolumeOptions{
+		"v1":     {Share: "vol"},
+		"v1copy": {Share: "vol"},
+		"s1":     {Share: "shared", Subdir: true, RemotePath: "vols/v1"},
+		"s1sub":  {Share: "shared", Subdir: true, RemotePath: "vols/v1/sub"},
+	}
+	for name, o := range records {
+		if err := d.meta.Set(name, volumeMetadata{Account: "devstoreaccount1", Options: o}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"v1", "s1"} {
+		if resp := d.Remove(volume.Request{Name: name}); resp.Err != "" {
+			t.Errorf("%s: %s", name, resp.Err)
+		}
+	}
+	want := []string{"shared/", "shared/vols/", "shared/vols/v1/", "shared/vols/v1/sub/", "shared/vols/v1/sub/f", "vol/", "vol/f"}
+	if got := tree.paths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// the last volume using the share removes it
+	if resp := d.Remove(volume.Request{Name: "v1copy"}); resp.Err != "" {
+		t.Error(resp.Err)
+	}
+	if tree.dirs["vol"] {
+		t.Error("share of the last volume not removed")
+	}
+
+	// a subdirectory volume without a directory never removes the share
+	if err := d.meta.Set("broken", volumeMetadata{Options: VolumeOptions{Share: "shared", Subdir: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := d.Remove(volume.Request{Name: "broken"}); !strings.Contains(resp.Err, "without 'remotepath'") {
+		t.Errorf("got error %q", resp.Err)
+	}
+	if !tree.dirs["shared/vols/v1/sub"] {
+		t.Error("subdirectory removed")
+	}
+}
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// fileAPIVersion is the Azure Storage REST API version used by fileAPI.
+const fileAPIVersion = "2017-04-17"
+
+const (
+	// requestTimeout limits File Service requests, including reading the
+	// response. File downloads take as long as the file is large, so for
+	// those it only limits the wait for the response headers.
+	requestTimeout = 60 * time.Second
+
+	// downloadIdleTimeout is how long a file download may go without
+	// receiving any data before it is aborted.
+	downloadIdleTimeout = 60 * time.Second
+)
+
+// fileAPI is a minimal client for the Azure File Service REST API. Unlike the
+// vendored storage SDK, it covers directories, files and listings, and tags
+// requests with the ID of the plugin request they are made for. Requests are
+// authenticated with Shared Key authorization.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/file-service-rest-api
+type fileAPI struct {
+	account  string
+	key      []byte
+	endpoint *url.URL
+	client   *http.Client
+
+	// download is used for reading files. It has no overall timeout,
+	// downloads are aborted when they stall for idleTimeout instead.
+	download    *http.Client
+	idleTimeout time.Duration
+
+	// requestID is sent as x-ms-client-request-id, which Azure records in
+	// its storage analytics logs.
+	requestID string
+
+	// span is the parent of the spans traced for requests, if any.
+	span *span
+}
+
+func newFileAPI(accountName, accountKey string, endpoint *url.URL) (*fileAPI, error) {
+	key, err := base64.StdEncoding.DecodeString(accountKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode account key: %v", err)
+	}
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: requestTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	return &fileAPI{
+		account:     accountName,
+		key:         key,
+		endpoint:    endpoint,
+		client:      &http.Client{Transport: transport, Timeout: requestTimeout},
+		download:    &http.Client{Transport: transport},
+		idleTimeout: downloadIdleTimeout,
+	}, nil
+}
+
+// fileEndpoint returns the File Service endpoint of the account: endpoint if
+// it is set, otherwise https://<account>.file.<storageBase>. An explicit
+// endpoint may use http, a custom port and a path, for instance
+// http://127.0.0.1:10004/devstoreaccount1 for an emulator with path-style
+// addressing.
+func fileEndpoint(accountName, storageBase, endpoint string) (*url.URL, error) {
+	if endpoint == "" {
+		return &url.URL{Scheme: "https", Host: fmt.Sprintf("%s.file.%s", accountName, storageBase)}, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file endpoint %q: %v", endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid file endpoint %q: must be an http:// or https:// URL", endpoint)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("invalid file endpoint %q: must not have credentials, query or fragment", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return u, nil
+}
+
+// endpointHost returns the host name of the endpoint without the port.
+func endpointHost(u *url.URL) string {
+	if h, _, err := net.SplitHostPort(u.Host); err == nil {
+		return strings.Trim(h, "[]")
+	}
+	return u.Host
+}
+
+// withRequest returns a copy of the client that tags its requests with id
+// and traces them as children of parent.
+func (f *fileAPI) withRequest(id string, parent *span) *fileAPI {
+	c := *f
+	c.requestID = id
+	c.span = parent
+	return &c
+}
+
+// fileAPIError is returned for unsuccessful File Service responses.
+type fileAPIError struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+	RequestID  string
+}
+
+func (e fileAPIError) Error() string {
+	return fmt.Sprintf("storage: service returned error: StatusCode=%d, ErrorCode=%s, ErrorMessage=%s, RequestId=%s",
+		e.StatusCode, e.Code, strings.TrimSpace(e.Message), e.RequestID)
+}
+
+// isStatus reports whether err is a fileAPIError with the given status code.
+func isStatus(err error, code int) bool {
+	e, ok := err.(fileAPIError)
+	return ok && e.StatusCode == code
+}
+
+// fileEntry is an item in a directory listing.
+type fileEntry struct {
+	Name  string
+	IsDir bool
+	Size  int64
+}
+
+// shareEntry is a share in the storage account.
+type shareEntry struct {
+	Name     string
+	Metadata map[string]string
+}
+
+// ListShares returns the shares in the account whose names start with
+// prefix, along with their metadata.
+func (f *fileAPI) ListShares(prefix string) ([]shareEntry, error) {
+	var (
+		shares []shareEntry
+		marker string
+	)
+	for {
+		q := url.Values{"comp": {"list"}, "include": {"metadata"}}
+		if prefix != "" {
+			q.Set("prefix", prefix)
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := f.do("GET", "/", q, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Shares []struct {
+				Name     string `xml:"Name"`
+				Metadata struct {
+					Items []struct {
+						XMLName xml.Name
+						Value   string `xml:",chardata"`
+					} `xml:",any"`
+				} `xml:"Metadata"`
+			} `xml:"Shares>Share"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse share listing: %v", err)
+		}
+		for _, sh := range out.Shares {
+			e := shareEntry{Name: sh.Name, Metadata: make(map[string]string)}
+			for _, m := range sh.Metadata.Items {
+				e.Metadata[strings.ToLower(m.XMLName.Local)] = m.Value
+			}
+			shares = append(shares, e)
+		}
+		if out.NextMarker == "" {
+			return shares, nil
+		}
+		marker = out.NextMarker
+	}
+}
+
+// CreateShare creates a share. It fails with a 409 Conflict fileAPIError if
+// the share already exists.
+func (f *fileAPI) CreateShare(share string) error {
+	resp, err := f.do("PUT", resourcePath(share, ""), url.Values{"restype": {"share"}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// CreateShareIfNotExists creates a share if it does not exist. Returns true
+// if the share is newly created or false if it already exists.
+func (f *fileAPI) CreateShareIfNotExists(share string) (bool, error) {
+	if err := f.CreateShare(share); err != nil {
+		if isStatus(err, http.StatusConflict) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// DeleteShareIfExists deletes a share if it exists. Returns true if the
+// share is deleted or false if it does not exist.
+func (f *fileAPI) DeleteShareIfExists(share string) (bool, error) {
+	resp, err := f.do("DELETE", resourcePath(share, ""), url.Values{"restype": {"share"}}, nil, nil, 0)
+	if err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// CreateDirectory creates a directory in the share. Returns true if the
+// directory is newly created or false if it already exists.
+func (f *fileAPI) CreateDirectory(share, dir string) (bool, error) {
+	resp, err := f.do("PUT", resourcePath(share, dir), url.Values{"restype": {"directory"}}, nil, nil, 0)
+	if err != nil {
+		if isStatus(err, http.StatusConflict) {
+			return false, nil
+		}
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// CreateDirectoryAll creates a directory in the share along with any
+// parents that do not exist yet.
+func (f *fileAPI) CreateDirectoryAll(share, dir string) error {
+	var p string
+	for _, c := range strings.Split(strings.Trim(dir, "/"), "/") {
+		p = path.Join(p, c)
+		if _, err := f.CreateDirectory(share, p); err != nil {
+			return fmt.Errorf("cannot create directory %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// ListDirectory returns the files and directories directly under dir.
+func (f *fileAPI) ListDirectory(share, dir string) ([]fileEntry, error) {
+	var (
+		entries []fileEntry
+		marker  string
+	)
+	for {
+		q := url.Values{"restype": {"directory"}, "comp": {"list"}}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := f.do("GET", resourcePath(share, dir), q, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var out struct {
+			Files []struct {
+				Name string `xml:"Name"`
+				Size int64  `xml:"Properties>Content-Length"`
+			} `xml:"Entries>File"`
+			Directories []struct {
+				Name string `xml:"Name"`
+			} `xml:"Entries>Directory"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&out)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse directory listing: %v", err)
+		}
+		for _, d := range out.Directories {
+			entries = append(entries, fileEntry{Name: d.Name, IsDir: true})
+		}
+		for _, e := range out.Files {
+			entries = append(entries, fileEntry{Name: e.Name, Size: e.Size})
+		}
+		if out.NextMarker == "" {
+			return entries, nil
+		}
+		marker = out.NextMarker
+	}
+}
+
+// maxRangeSize is the largest range a single Put Range call can write.
+const maxRangeSize = 4 << 20
+
+// CreateFile creates (or replaces) a file of the given size in the share.
+// The content is zero-filled until written with PutRange.
+func (f *fileAPI) CreateFile(share, file string, size int64) error {
+	h := http.Header{}
+	h.Set("x-ms-type", "file")
+	h.Set("x-ms-content-length", strconv.FormatInt(size, 10))
+	resp, err := f.do("PUT", resourcePath(share, file), nil, h, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// PutRange writes data to a file in the share at offset. data must not be
+// larger than maxRangeSize.
+func (f *fileAPI) PutRange(share, file string, offset int64, data []byte) error {
+	h := http.Header{}
+	h.Set("x-ms-write", "update")
+	h.Set("x-ms-range", fmt.Sprintf("bytes=%d-%d", offset, offset+int64(len(data))-1))
+	resp, err := f.do("PUT", resourcePath(share, file), url.Values{"comp": {"range"}}, h, bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// GetFile opens a file in the share for reading. Returns the content, which
+// the caller must close, along with its size and last modification time.
+func (f *fileAPI) GetFile(share, file string) (io.ReadCloser, int64, time.Time, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	resp, err := f.doWith(ctx, f.download, "GET", resourcePath(share, file), nil, nil, nil, 0)
+	if err != nil {
+		cancel()
+		return nil, 0, time.Time{}, err
+	}
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return newIdleTimeoutBody(resp.Body, f.idleTimeout, cancel), resp.ContentLength, mtime, nil
+}
+
+// idleTimeoutBody is the body of a file download. A read that receives no
+// data for timeout cancels the request and fails, so that a stalled download
+// does not hang. Time spent between reads is not counted, the caller may be
+// slow to consume the data.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  func()
+	expired int32 // set atomically when the timer fires
+}
+
+func newIdleTimeoutBody(body io.ReadCloser, timeout time.Duration, cancel func()) *idleTimeoutBody {
+	b := &idleTimeoutBody{body: body, timeout: timeout, cancel: cancel}
+	b.timer = time.AfterFunc(timeout, func() {
+		atomic.StoreInt32(&b.expired, 1)
+		cancel()
+	})
+	b.timer.Stop()
+	return b
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	b.timer.Reset(b.timeout)
+	n, err := b.body.Read(p)
+	b.timer.Stop()
+	if err != nil && atomic.LoadInt32(&b.expired) == 1 {
+		err = fmt.Errorf("download stalled, no data received for %v", b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	err := b.body.Close()
+	b.cancel()
+	return err
+}
+
+// GetDirectoryModTime returns the last modification time of a directory.
+func (f *fileAPI) GetDirectoryModTime(share, dir string) (time.Time, error) {
+	resp, err := f.do("GET", resourcePath(share, dir), url.Values{"restype": {"directory"}}, nil, nil, 0)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return mtime, nil
+}
+
+// DeleteFile deletes a file from the share.
+func (f *fileAPI) DeleteFile(share, file string) error {
+	resp, err := f.do("DELETE", resourcePath(share, file), nil, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeleteDirectory deletes an empty directory from the share.
+func (f *fileAPI) DeleteDirectory(share, dir string) error {
+	resp, err := f.do("DELETE", resourcePath(share, dir), url.Values{"restype": {"directory"}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DeleteDirectoryAll deletes a directory and everything under it. It is not
+// an error if the directory does not exist.
+func (f *fileAPI) DeleteDirectoryAll(share, dir string) error {
+	if err := f.DeleteDirectoryContents(share, dir); err != nil {
+		if isStatus(err, http.StatusNotFound) {
+			return nil
+		}
+		return err
+	}
+	if err := f.DeleteDirectory(share, dir); err != nil && !isStatus(err, http.StatusNotFound) {
+		return err
+	}
+	return nil
+}
+
+// DeleteDirectoryContents deletes everything under a directory, leaving the
+// directory itself in place. An empty dir refers to the root of the share.
+func (f *fileAPI) DeleteDirectoryContents(share, dir string) error {
+	entries, err := f.ListDirectory(share, dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := path.Join(dir, e.Name)
+		if e.IsDir {
+			err = f.DeleteDirectoryAll(share, p)
+		} else {
+			err = f.DeleteFile(share, p)
+		}
+		if err != nil && !isStatus(err, http.StatusNotFound) {
+			return fmt.Errorf("cannot delete %q: %v", p, err)
+		}
+	}
+	return nil
+}
+
+// SnapshotShare takes a read-only snapshot of the share and returns the
+// snapshot timestamp identifying it.
+func (f *fileAPI) SnapshotShare(share string) (string, error) {
+	resp, err := f.do("PUT", resourcePath(share, ""), url.Values{"restype": {"share"}, "comp": {"snapshot"}}, nil, nil, 0)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("x-ms-snapshot"), nil
+}
+
+// SetShareQuota sets the maximum size of the share in GiB.
+func (f *fileAPI) SetShareQuota(share string, quota int) error {
+	h := http.Header{}
+	h.Set("x-ms-share-quota", strconv.Itoa(quota))
+	resp, err := f.do("PUT", resourcePath(share, ""), url.Values{"restype": {"share"}, "comp": {"properties"}}, h, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// ShareQuota returns the maximum size of the share in GiB.
+func (f *fileAPI) ShareQuota(share string) (int, error) {
+	resp, err := f.do("GET", resourcePath(share, ""), url.Values{"restype": {"share"}}, nil, nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	quota, err := strconv.Atoi(resp.Header.Get("x-ms-share-quota"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid share quota %q in response", resp.Header.Get("x-ms-share-quota"))
+	}
+	return quota, nil
+}
+
+// SetShareMetadata replaces the metadata of the share. Names must be valid
+// C# identifiers and values printable ASCII.
+func (f *fileAPI) SetShareMetadata(share string, metadata map[string]string) error {
+	h := http.Header{}
+	for k, v := range metadata {
+		h.Set("x-ms-meta-"+k, v)
+	}
+	resp, err := f.do("PUT", resourcePath(share, ""), url.Values{"restype": {"share"}, "comp": {"metadata"}}, h, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// DirectoryUsage returns the number of files and their total size in bytes
+// under dir, recursively.
+func (f *fileAPI) DirectoryUsage(share, dir string) (files int, bytes int64, err error) {
+	entries, err := f.ListDirectory(share, dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, e := range entries {
+		if !e.IsDir {
+			files++
+			bytes += e.Size
+			continue
+		}
+		n, b, err := f.DirectoryUsage(share, path.Join(dir, e.Name))
+		if err != nil {
+			return 0, 0, err
+		}
+		files += n
+		bytes += b
+	}
+	return files, bytes, nil
+}
+
+// do executes a signed request against the File Service and returns the
+// response for successful (2xx) status codes; any other status code is
+// returned as fileAPIError. The caller must close the response body.
+func (f *fileAPI) do(method, resource string, query url.Values, headers http.Header, body io.Reader, contentLength int64) (*http.Response, error) {
+	return f.doWith(context.Background(), f.client, method, resource, query, headers, body, contentLength)
+}
+
+// doWith is do with the context of the request and the client to send it
+// with.
+func (f *fileAPI) doWith(ctx context.Context, client *http.Client, method, resource string, query url.Values, headers http.Header, body io.Reader, contentLength int64) (*http.Response, error) {
+	u := *f.endpoint
+	u.Path = f.endpoint.Path + resource
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	req.ContentLength = contentLength
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", fileAPIVersion)
+	if f.requestID != "" {
+		req.Header.Set("x-ms-client-request-id", f.requestID)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", f.account, f.sign(req)))
+
+	sp := startSpan(f.span, "fileapi "+method+" "+requestOperation(query))
+	if sp != nil {
+		sp.SetAttribute("http.method", method)
+		sp.SetAttribute("http.path", resource)
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), connectionTrace(sp)))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		sp.FinishErr(err)
+		return nil, err
+	}
+	sp.SetAttribute("http.status_code", resp.StatusCode)
+	sp.SetAttribute("azure.request_id", resp.Header.Get("x-ms-request-id"))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		sp.Finish("")
+		return resp, nil
+	}
+	sp.Finish(resp.Status)
+
+	defer resp.Body.Close()
+	e := fileAPIError{
+		StatusCode: resp.StatusCode,
+		RequestID:  resp.Header.Get("x-ms-request-id"),
+	}
+	if b, err := ioutil.ReadAll(resp.Body); err == nil && len(b) > 0 {
+		xml.Unmarshal(b, &e)
+	}
+	if e.Code == "" {
+		e.Code = resp.Status
+	}
+	return nil, e
+}
+
+// requestOperation names the File Service operation of a request for
+// tracing, e.g. "share/metadata" or "range".
+func requestOperation(query url.Values) string {
+	op := query.Get("restype")
+	if comp := query.Get("comp"); comp != "" {
+		if op != "" {
+			op += "/"
+		}
+		op += comp
+	}
+	if op == "" {
+		op = "file"
+	}
+	return op
+}
+
+// connectionTrace records the time spent resolving the storage endpoint and
+// connecting to it on sp.
+func connectionTrace(sp *span) *httptrace.ClientTrace {
+	var dnsStart, connectStart time.Time
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			sp.SetAttribute("net.dns_duration", time.Since(dnsStart))
+		},
+		ConnectStart: func(string, string) { connectStart = time.Now() },
+		ConnectDone: func(string, string, error) {
+			sp.SetAttribute("net.connect_duration", time.Since(connectStart))
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			sp.SetAttribute("net.conn_reused", info.Reused)
+		},
+	}
+}
+
+// sign computes the Shared Key signature of the request.
+//
+// See https://docs.microsoft.com/en-us/rest/api/storageservices/authorize-with-shared-key
+func (f *fileAPI) sign(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+	h := req.Header
+	s := strings.Join([]string{
+		req.Method,
+		h.Get("Content-Encoding"),
+		h.Get("Content-Language"),
+		contentLength,
+		h.Get("Content-MD5"),
+		h.Get("Content-Type"),
+		"", // Date, x-ms-date is used instead
+		h.Get("If-Modified-Since"),
+		h.Get("If-Match"),
+		h.Get("If-None-Match"),
+		h.Get("If-Unmodified-Since"),
+		h.Get("Range"),
+	}, "\n") + "\n" + canonicalizedHeaders(h) + f.canonicalizedResource(req.URL)
+
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(s))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func canonicalizedHeaders(h http.Header) string {
+	var keys []string
+	for k := range h {
+		if k = strings.ToLower(k); strings.HasPrefix(k, "x-ms-") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b []string
+	for _, k := range keys {
+		b = append(b, fmt.Sprintf("%s:%s\n", k, strings.TrimSpace(h.Get(k))))
+	}
+	return strings.Join(b, "")
+}
+
+func (f *fileAPI) canonicalizedResource(u *url.URL) string {
+	s := "/" + f.account + u.EscapedPath()
+	q := u.Query()
+	var keys []string
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := q[k]
+		sort.Strings(v)
+		s += fmt.Sprintf("\n%s:%s", strings.ToLower(k), strings.Join(v, ","))
+	}
+	return s
+}
+
+// resourcePath returns the URL path of a share, or a file or directory
+// within the share.
+func resourcePath(share, p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return "/" + share
+	}
+	return "/" + share + "/" + p
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelOptionPrefix marks volume options that are labels rather than driver
+// options. The docker engine does not pass 'docker volume create --label' to
+// volume drivers, so labels are given as '-o label.<key>=<value>'.
+const labelOptionPrefix = "label."
+
+// Share metadata names the driver tags the shares it creates with. Label
+// metadata names start with labelMetadataPrefix. The plugin API does not
+// tell the driver who created a volume, so the shares record the driver
+// version they were created with, not a user.
+const (
+	metaCreatedWith     = "createdwith"
+	metaDockerHost      = "dockerhost"
+	metaDockerVolume    = "dockervolume"
+	labelMetadataPrefix = "label_"
+)
+
+// labelKeyRe matches label keys: letters, numbers, '.', '-' and '_',
+// starting and ending with a letter or number.
+var labelKeyRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._-]*[A-Za-z0-9])?$`)
+
+// isLabelOption reports whether the volume option is a label.
+func isLabelOption(name string) bool {
+	return strings.HasPrefix(name, labelOptionPrefix)
+}
+
+// parseLabels returns the labels among the volume options, keyed without
+// the option prefix.
+func parseLabels(meta map[string]string) (map[string]string, error) {
+	var (
+		labels = make(map[string]string)
+		names  = make(map[string]string) // share metadata name to label key
+		errs   optionErrors
+	)
+	var keys []string
+	for k := range meta {
+		if isLabelOption(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, opt := range keys {
+		key, value := strings.TrimPrefix(opt, labelOptionPrefix), meta[opt]
+		if !labelKeyRe.MatchString(key) {
+			errs.add(opt, fmt.Errorf("label key %q must consist of letters, numbers, '.', '-' and '_'", key))
+			continue
+		}
+		if err := validateLabelValue(value); err != nil {
+			errs.add(opt, err)
+			continue
+		}
+		n := labelMetadataName(key)
+		if other, ok := names[n]; ok {
+			errs.add(opt, fmt.Errorf("label key %q clashes with %q in share metadata", key, other))
+			continue
+		}
+		names[n] = key
+		labels[key] = value
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	if len(labels) == 0 {
+		return nil, nil
+	}
+	return labels, nil
+}
+
+// validateLabelValue checks that the value can be sent as share metadata,
+// which is carried in HTTP headers.
+func validateLabelValue(v string) error {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] > 0x7e {
+			return fmt.Errorf("label value %q must consist of printable ASCII characters", v)
+		}
+	}
+	if strings.TrimSpace(v) != v {
+		return fmt.Errorf("label value %q must not start or end with spaces", v)
+	}
+	return nil
+}
+
+// labelMetadataName returns the share metadata name for a label key. Share
+// metadata names must be valid C# identifiers and are case-insensitive.
+func labelMetadataName(key string) string {
+	return labelMetadataPrefix + strings.ToLower(strings.NewReplacer(".", "_", "-", "_").Replace(key))
+}
+
+// shareMetadata returns the metadata a share created for a volume is tagged
+// with, so that the share can be traced back to the volume and host.
+func shareMetadata(volumeName, hostname string, labels map[string]string) map[string]string {
+	createdWith := "azurefile-dockervolumedriver"
+	if GitSummary != "" {
+		createdWith += " " + GitSummary
+	}
+	m := map[string]string{
+		metaCreatedWith: createdWith,
+		// the encoded form is plain ASCII, as header values must be
+		metaDockerVolume: encodeVolumeName(volumeName),
+	}
+	if hostname != "" {
+		m[metaDockerHost] = hostname
+	}
+	for k, v := range labels {
+		m[labelMetadataName(k)] = v
+	}
+	return m
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	labels, err := parseLabels(map[string]string{
+		"share":             "myshare",
+		"label.env":         "prod",
+		"label.com.acme.id": "42",
+		"label.Team_A":      "web team",
+		"label.empty":       "",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"env": "prod", "com.acme.id": "42", "Team_A": "web team", "empty": ""}
+	if !reflect.DeepEqual(labels, want) {
+		t.Errorf("got %v, want %v", labels, want)
+	}
+
+	if labels, err := parseLabels(map[string]string{"share": "myshare"}); labels != nil || err != nil {
+		t.Errorf("got %v, %v without labels", labels, err)
+	}
+}
+
+func TestParseLabelsInvalid(t *testing.T) {
+	cases := []struct {
+		opts map[string]string
+		want string
+	}{
+		{map[string]string{"label.": "x"}, `label key "" must consist of`},
+		{map[string]string{"label.-a": "x"}, `label key "-a" must consist of`},
+		{map[string]string{"label.a b": "x"}, `label key "a b" must consist of`},
+		{map[string]string{"label.a.": "x"}, `label key "a." must consist of`},
+		{map[string]string{"label.a/b": "x"}, `label key "a/b" must consist of`},
+		{map[string]string{"label.env": "prod\n"}, "must consist of printable ASCII characters"},
+		{map[string]string{"label.env": "prödüction"}, "must consist of printable ASCII characters"},
+		{map[string]string{"label.env": " prod"}, "must not start or end with spaces"},
+		{map[string]string{"label.env": "prod "}, "must not start or end with spaces"},
+		// keys are checked in sorted order, the later key is reported
+		{map[string]string{"label.a.b": "1", "label.a-b": "2"}, `invalid value for 'label.a.b': label key "a.b" clashes with "a-b"`},
+		{map[string]string{"label.A_B": "1", "label.a-b": "2"}, `invalid value for 'label.a-b': label key "a-b" clashes with "A_B"`},
+	}
+	for _, c := range cases {
+		labels, err := parseLabels(c.opts)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%v: got error %v, want %q", c.opts, err, c.want)
+		}
+		if labels != nil {
+			t.Errorf("%v: got labels %v with an error", c.opts, labels)
+		}
+	}
+
+	// every invalid label is reported
+	_, err := parseLabels(map[string]string{"label.-a": "x", "label.b": " y", "label.c": "z"})
+	if errs, ok := err.(optionErrors); !ok || len(errs) != 2 {
+		t.Errorf("got %v, want two errors", err)
+	}
+}
+
+func TestLabelMetadataName(t *testing.T) {
+	cases := map[string]string{
+		"env":         "label_env",
+		"com.acme.id": "label_com_acme_id",
+		"Team-A":      "label_team_a",
+		"x_1":         "label_x_1",
+	}
+	for in, want := range cases {
+		if got := labelMetadataName(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestShareMetadata(t *testing.T) {
+	defer func(s string) { GitSummary = s }(GitSummary)
+	GitSummary = "v0.5.1-3-gabcdef"
+
+	got := shareMetadata("My Volume", "host1", map[string]string{"env": "prod", "com.acme.id": "42"})
+	want := map[string]string{
+		"createdwith":       "azurefile-dockervolumedriver v0.5.1-3-gabcdef",
+		"dockervolume":      "My%20Volume",
+		"dockerhost":        "host1",
+		"label_env":         "prod",
+		"label_com_acme_id": "42",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	GitSummary = ""
+	got = shareMetadata("myvol", "", nil)
+	want = map[string]string{
+		"createdwith":  "azurefile-dockervolumedriver",
+		"dockervolume": "myvol",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/coreos/go-systemd/activation"
+	"github.com/coreos/go-systemd/util"
+	"github.com/docker/go-connections/sockets"
+)
+
+const (
+	pluginSpecDir = "/etc/docker/plugins"
+	pluginSockDir = "/run/docker/plugins"
+
+	defaultSocketGroup = "docker"
+	defaultSocketMode  = "0660"
+)
+
+// unixConfig configures serving the plugin API on a unix socket.
+type unixConfig struct {
+	// Path of the socket. Defaults to <name>.sock in the docker plugin
+	// socket directory.
+	Path string
+
+	// Group owning the socket, by name or ID. Empty leaves the group
+	// unchanged.
+	Group string
+
+	// Mode is the octal permission mode of the socket.
+	Mode string
+}
+
+// socketPath returns the socket path for the plugin name.
+func (c unixConfig) socketPath(name string) string {
+	if c.Path != "" {
+		return c.Path
+	}
+	return filepath.Join(pluginSockDir, name+".sock")
+}
+
+func (c unixConfig) validate() error {
+	if c.Path != "" && !filepath.IsAbs(c.Path) {
+		return fmt.Errorf("socket path %q must be absolute", c.Path)
+	}
+	if _, err := parseMode(c.Mode); err != nil {
+		return fmt.Errorf("invalid socket mode: %v", err)
+	}
+	if c.Group != "" {
+		if _, err := lookupGroupID(c.Group); err != nil {
+			return fmt.Errorf("invalid socket group: %v", err)
+		}
+	}
+	return nil
+}
+
+// newUnixListener listens on the configured unix socket, or on the socket
+// passed by systemd socket activation if there is one. The socket settings
+// only apply, and are only validated, when the driver creates the socket.
+func newUnixListener(name string, cfg unixConfig) (net.Listener, error) {
+	if l, err := activatedListener(); err != nil || l != nil {
+		return l, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	path := cfg.socketPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("cannot create socket directory: %v", err)
+	}
+	// refuse to take over the socket of another running instance
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("socket %s is in use by another process", path)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("cannot remove stale socket %s: %v", path, err)
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen on unix socket %s: %v", path, err)
+	}
+	if cfg.Group != "" {
+		gid, _ := lookupGroupID(cfg.Group)
+		if err := os.Chown(path, -1, gid); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("cannot set group of socket %s: %v", path, err)
+		}
+	}
+	mode, _ := strconv.ParseUint(cfg.Mode, 8, 32)
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("cannot set permissions of socket %s: %v", path, err)
+	}
+	return l, nil
+}
+
+// activatedListener returns the listener passed by systemd socket
+// activation, or nil if the process was not socket activated.
+func activatedListener() (net.Listener, error) {
+	if !util.IsRunningSystemd() {
+		return nil, nil
+	}
+	files := activation.Files(true)
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if len(files) > 1 {
+		return nil, fmt.Errorf("expected only one socket from systemd, got %d", len(files))
+	}
+	l, err := net.FileListener(files[0])
+	if err != nil {
+		return nil, fmt.Errorf("cannot use socket from systemd: %v", err)
+	}
+	files[0].Close()
+	return l, nil
+}
+
+// lookupGroupID returns the numeric ID of a group given by name or ID.
+func lookupGroupID(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	id, err := lookupGID(group)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// tcpConfig configures serving the plugin API over TCP.
+type tcpConfig struct {
+	Addr string
+
+	// AdvertiseAddr is the host:port the docker engine connects to, written
+	// to the discovery file. Defaults to Addr, which then must name a
+	// concrete host rather than all interfaces.
+	AdvertiseAddr string
+
+	// Server certificate and key. TLS is enabled when both are set.
+	CertFile string
+	KeyFile  string
+
+	// CAFile is the CA bundle client certificates must be signed by. When
+	// set, clients must present a certificate (mutual TLS). It is also
+	// written to the discovery file for the engine to verify the server.
+	CAFile string
+
+	// ClientCertFile and ClientKeyFile are the certificate the docker engine
+	// presents to the driver. They are only written to the discovery file.
+	ClientCertFile string
+	ClientKeyFile  string
+
+	// SpecDir is where the plugin discovery file is written.
+	SpecDir string
+}
+
+func (c tcpConfig) tlsEnabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+func (c tcpConfig) validate() error {
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return fmt.Errorf("both TLS certificate and key must be provided")
+	}
+	if !c.tlsEnabled() && (c.CAFile != "" || c.ClientCertFile != "" || c.ClientKeyFile != "") {
+		return fmt.Errorf("TLS CA and client certificate options require TLS certificate and key")
+	}
+	if (c.ClientCertFile == "") != (c.ClientKeyFile == "") {
+		return fmt.Errorf("both TLS client certificate and key must be provided")
+	}
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return fmt.Errorf("invalid TCP address %q: %v", c.Addr, err)
+	}
+	// Anyone who can reach the API can create and remove volumes and their
+	// shares in the storage account, so it is only served to clients with a
+	// certificate unless it is bound to the loopback interface.
+	if !isLoopbackHost(host) && (!c.tlsEnabled() || c.CAFile == "") {
+		return fmt.Errorf("serving the plugin API on %s requires mutual TLS (TLS certificate, key and CA), it is not a loopback address", c.Addr)
+	}
+	if c.AdvertiseAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdvertiseAddr); err != nil {
+			return fmt.Errorf("invalid TCP advertise address %q: %v", c.AdvertiseAddr, err)
+		}
+	} else if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		return fmt.Errorf("TCP address %s listens on all interfaces, an advertise address for the docker engine to connect to is required", c.Addr)
+	}
+	return nil
+}
+
+// isLoopbackHost reports whether host is localhost or a loopback IP address.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// advertiseAddr returns the address written to the discovery file for the
+// listener l: the advertise address if set, otherwise the configured host
+// with the port l listens on.
+func (c tcpConfig) advertiseAddr(l net.Listener) (string, error) {
+	if c.AdvertiseAddr != "" {
+		return c.AdvertiseAddr, nil
+	}
+	host, _, err := net.SplitHostPort(c.Addr)
+	if err != nil {
+		return "", err
+	}
+	_, port, err := net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// newTCPListener listens on the configured TCP address, with TLS if
+// configured, and writes the plugin discovery file for the docker engine.
+// Returns the path of the discovery file, which the caller should remove
+// when it stops serving.
+func newTCPListener(name string, cfg tcpConfig) (net.Listener, string, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, "", err
+	}
+	var tlsConfig *tls.Config
+	if cfg.tlsEnabled() {
+		var err error
+		if tlsConfig, err = serverTLSConfig(cfg); err != nil {
+			return nil, "", err
+		}
+	}
+	l, err := sockets.NewTCPSocket(cfg.Addr, tlsConfig)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot listen on %s: %v", cfg.Addr, err)
+	}
+	addr, err := cfg.advertiseAddr(l)
+	if err != nil {
+		l.Close()
+		return nil, "", err
+	}
+	spec, err := writePluginSpec(name, addr, cfg)
+	if err != nil {
+		l.Close()
+		return nil, "", err
+	}
+	return l, spec, nil
+}
+
+func serverTLSConfig(cfg tcpConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load TLS certificate: %v", err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.CAFile != "" {
+		b, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read TLS CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("no certificates found in TLS CA file %s", cfg.CAFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// writePluginSpec writes the file the docker engine discovers the plugin
+// with: a .spec file with the URL for plain TCP, or a .json file which
+// also carries the TLS settings.
+//
+// See https://docs.docker.com/engine/extend/plugin_api/#plugin-discovery
+func writePluginSpec(name, addr string, cfg tcpConfig) (string, error) {
+	dir := cfg.SpecDir
+	if dir == "" {
+		dir = pluginSpecDir
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("cannot create plugin spec directory: %v", err)
+	}
+
+	var (
+		path string
+		b    []byte
+	)
+	if !cfg.tlsEnabled() {
+		path = filepath.Join(dir, name+".spec")
+		b = []byte("tcp://" + addr)
+	} else {
+		type tlsSpec struct {
+			InsecureSkipVerify bool
+			CAFile             string `json:",omitempty"`
+			CertFile           string `json:",omitempty"`
+			KeyFile            string `json:",omitempty"`
+		}
+		var err error
+		for _, f := range []*string{&cfg.CAFile, &cfg.ClientCertFile, &cfg.ClientKeyFile} {
+			if *f == "" {
+				continue
+			}
+			// the engine resolves paths relative to its own working directory
+			if *f, err = filepath.Abs(*f); err != nil {
+				return "", err
+			}
+		}
+		spec := struct {
+			Name      string
+			Addr      string
+			TLSConfig tlsSpec
+		}{
+			Name: name,
+			Addr: "https://" + addr,
+			TLSConfig: tlsSpec{
+				CAFile:   cfg.CAFile,
+				CertFile: cfg.ClientCertFile,
+				KeyFile:  cfg.ClientKeyFile,
+			},
+		}
+		if b, err = json.MarshalIndent(spec, "", "  "); err != nil {
+			return "", fmt.Errorf("cannot serialize plugin spec: %v", err)
+		}
+		path = filepath.Join(dir, name+".json")
+	}
+	// a discovery file of the other kind left behind would take precedence
+	for _, ext := range []string{".spec", ".json"} {
+		if p := filepath.Join(dir, name+ext); p != path {
+			os.Remove(p)
+		}
+	}
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return "", fmt.Errorf("cannot write plugin spec: %v", err)
+	}
+	return path, nil
+}
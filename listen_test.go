@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTCPConfigValidate(t *testing.T) {
+	mtls := tcpConfig{CertFile: "cert.pem", KeyFile: "key.pem", CAFile: "ca.pem"}
+	withAddr := func(c tcpConfig, addr, advertise string) tcpConfig {
+		c.Addr, c.AdvertiseAddr = addr, advertise
+		return c
+	}
+
+	valid := []tcpConfig{
+		{Addr: "127.0.0.1:9000"},
+		{Addr: "localhost:9000"},
+		{Addr: "[::1]:9000"},
+		{Addr: "127.0.0.1:9000", CertFile: "cert.pem", KeyFile: "key.pem"},
+		withAddr(mtls, "10.0.0.4:9000", ""),
+		withAddr(mtls, "driver.example.com:9000", ""),
+		withAddr(mtls, ":9000", "driver.example.com:9000"),
+		withAddr(mtls, "0.0.0.0:9000", "10.0.0.4:9000"),
+	}
+	for _, c := range valid {
+		if err := c.validate(); err != nil {
+			t.Errorf("%+v: %v", c, err)
+		}
+	}
+
+	invalid := []struct {
+		cfg tcpConfig
+		err string
+	}{
+		{tcpConfig{Addr: "10.0.0.4:9000"}, "requires mutual TLS"},
+		{tcpConfig{Addr: ":9000", AdvertiseAddr: "10.0.0.4:9000"}, "not a loopback address"},
+		{tcpConfig{Addr: "10.0.0.4:9000", CertFile: "cert.pem", KeyFile: "key.pem"}, "requires mutual TLS"},
+		{withAddr(mtls, ":9000", ""), "listens on all interfaces"},
+		{withAddr(mtls, "[::]:9000", ""), "listens on all interfaces"},
+		{withAddr(mtls, ":9000", "driver.example.com"), "invalid TCP advertise address"},
+		{tcpConfig{Addr: "127.0.0.1"}, "invalid TCP address"},
+		{tcpConfig{Addr: "127.0.0.1:9000", CertFile: "cert.pem"}, "both TLS certificate and key"},
+		{tcpConfig{Addr: "127.0.0.1:9000", CAFile: "ca.pem"}, "require TLS certificate and key"},
+	}
+	for _, c := range invalid {
+		err := c.cfg.validate()
+		if err == nil || !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%+v: got error %v, want %q", c.cfg, err, c.err)
+		}
+	}
+}
+
+func TestNewTCPListenerSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azurefile-spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range []struct {
+		addr, advertise, want string
+	}{
+		{"127.0.0.1:0", "", "tcp://127.0.0.1:"},
+		{"localhost:0", "", "tcp://localhost:"},
+		{"127.0.0.1:0", "driver.internal:9000", "tcp://driver.internal:9000"},
+	} {
+		l, spec, err := newTCPListener("azurefile", tcpConfig{Addr: c.addr, AdvertiseAddr: c.advertise, SpecDir: dir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		l.Close()
+		b, err := ioutil.ReadFile(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := c.want
+		if strings.HasSuffix(want, ":") {
+			want += port
+		}
+		if string(b) != want {
+			t.Errorf("%s: spec %q, want %q", c.addr, b, want)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	logSinkStderr   = "stderr"
+	logSinkJournald = "journald"
+	logSinkSyslog   = "syslog"
+
+	// journaldSocket is where journald receives native protocol messages.
+	journaldSocket = "/run/systemd/journal/socket"
+)
+
+var (
+	allowedLogFormats = []string{logFormatText, logFormatJSON}
+	allowedLogSinks   = []string{logSinkStderr, logSinkJournald, logSinkSyslog}
+
+	allLogLevels = []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel, log.DebugLevel}
+)
+
+// logConfig configures the format, level and destination of log entries.
+type logConfig struct {
+	Format string
+	Level  string
+	Sink   string
+}
+
+// setupLogging configures the standard logger.
+func setupLogging(cfg logConfig) error {
+	level, err := log.ParseLevel(cfg.Level)
+	if err != nil {
+		return fmt.Errorf("invalid log level %q", cfg.Level)
+	}
+	log.SetLevel(level)
+
+	switch cfg.Format {
+	case logFormatText:
+		log.SetFormatter(&log.TextFormatter{})
+	case logFormatJSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("invalid log format %q (allowed: %v)", cfg.Format, allowedLogFormats)
+	}
+
+	var hook log.Hook
+	switch cfg.Sink {
+	case logSinkStderr:
+		return nil
+	case logSinkJournald:
+		hook, err = newJournaldHook()
+	case logSinkSyslog:
+		hook, err = newSyslogHook()
+	default:
+		return fmt.Errorf("invalid log sink %q (allowed: %v)", cfg.Sink, allowedLogSinks)
+	}
+	if err != nil {
+		return err
+	}
+	log.AddHook(hook)
+	log.SetOutput(ioutil.Discard)
+	return nil
+}
+
+// syslogHook sends log entries, formatted with the logger's formatter, to the
+// local syslog daemon.
+type syslogHook struct {
+	w *syslog.Writer
+}
+
+func newSyslogHook() (*syslogHook, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, "azurefile-dockervolumedriver")
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to syslog: %v", err)
+	}
+	return &syslogHook{w}, nil
+}
+
+func (h *syslogHook) Levels() []log.Level {
+	return allLogLevels
+}
+
+func (h *syslogHook) Fire(entry *log.Entry) error {
+	msg, err := entry.String()
+	if err != nil {
+		return err
+	}
+	msg = strings.TrimSuffix(msg, "\n")
+	switch entry.Level {
+	case log.DebugLevel:
+		return h.w.Debug(msg)
+	case log.InfoLevel:
+		return h.w.Info(msg)
+	case log.WarnLevel:
+		return h.w.Warning(msg)
+	case log.ErrorLevel:
+		return h.w.Err(msg)
+	case log.FatalLevel:
+		return h.w.Crit(msg)
+	default:
+		return h.w.Emerg(msg)
+	}
+}
+
+// journaldHook sends log entries to journald with the native protocol, so
+// that entry fields become journal fields (e.g. OPERATION, NAME).
+//
+// See https://www.freedesktop.org/wiki/Software/systemd/export/
+type journaldHook struct {
+	conn *net.UnixConn
+}
+
+func newJournaldHook() (*journaldHook, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to journald: %v", err)
+	}
+	return &journaldHook{conn}, nil
+}
+
+func (h *journaldHook) Levels() []log.Level {
+	return allLogLevels
+}
+
+func (h *journaldHook) Fire(entry *log.Entry) error {
+	var b bytes.Buffer
+	writeJournalField(&b, "MESSAGE", entry.Message)
+	writeJournalField(&b, "PRIORITY", journalPriority(entry.Level))
+	writeJournalField(&b, "SYSLOG_IDENTIFIER", "azurefile-dockervolumedriver")
+	writeJournalField(&b, "SYSLOG_PID", fmt.Sprint(os.Getpid()))
+
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		name := journalFieldName(k)
+		if name == "" {
+			continue
+		}
+		writeJournalField(&b, name, journalFieldValue(entry.Data[k]))
+	}
+	_, err := h.conn.Write(b.Bytes())
+	return err
+}
+
+// writeJournalField appends a field in the journal export format. Values
+// with newlines use the binary form: name, newline, little-endian 64-bit
+// length, value.
+func writeJournalField(b *bytes.Buffer, name, value string) {
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", name, value)
+		return
+	}
+	b.WriteString(name)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+// journalFieldName converts an entry field name to a journal field name,
+// which consists of uppercase letters, digits and underscores and does not
+// start with an underscore or digit. Returns "" if nothing is left.
+func journalFieldName(k string) string {
+	var b []byte
+	for i := 0; i < len(k) && len(b) < 64; i++ {
+		c := k[i]
+		switch {
+		case c >= 'a' && c <= 'z':
+			b = append(b, c-'a'+'A')
+		case c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+			b = append(b, c)
+		default:
+			b = append(b, '_')
+		}
+	}
+	s := strings.TrimLeft(string(b), "_0123456789")
+	switch s {
+	case "MESSAGE", "PRIORITY", "SYSLOG_IDENTIFIER", "SYSLOG_PID":
+		return "FIELD_" + s
+	}
+	return s
+}
+
+func journalFieldValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	if b, err := json.Marshal(v); err == nil {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// journalPriority maps log levels to syslog priorities.
+func journalPriority(l log.Level) string {
+	switch l {
+	case log.DebugLevel:
+		return "7"
+	case log.InfoLevel:
+		return "6"
+	case log.WarnLevel:
+		return "4"
+	case log.ErrorLevel:
+		return "3"
+	case log.FatalLevel:
+		return "2"
+	default:
+		return "0"
+	}
+}
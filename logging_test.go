@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestJournalFieldName(t *testing.T) {
+	cases := map[string]string{
+		"operation":              "OPERATION",
+		"requestID":              "REQUESTID",
+		"http.status_code":       "HTTP_STATUS_CODE",
+		"volume-name":            "VOLUME_NAME",
+		"_private":               "PRIVATE",
+		"1st":                    "ST",
+		"__9_x":                  "X",
+		"message":                "FIELD_MESSAGE",
+		"priority":               "FIELD_PRIORITY",
+		"syslog_pid":             "FIELD_SYSLOG_PID",
+		"___":                    "",
+		"é":                      "",
+		strings.Repeat("a", 100): strings.Repeat("A", 64),
+	}
+	for in, want := range cases {
+		if got := journalFieldName(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestWriteJournalField(t *testing.T) {
+	var b bytes.Buffer
+	writeJournalField(&b, "NAME", "myvol")
+	writeJournalField(&b, "MESSAGE", "mount failed\noutput=x")
+	writeJournalField(&b, "EMPTY", "")
+	want := "NAME=myvol\n" +
+		"MESSAGE\n\x15\x00\x00\x00\x00\x00\x00\x00mount failed\noutput=x\n" +
+		"EMPTY=\n"
+	if got := b.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestJournalFieldValue(t *testing.T) {
+	cases := []struct {
+		v    interface{}
+		want string
+	}{
+		{"text", "text"},
+		{errors.New("failed"), "failed"},
+		{42, "42"},
+		{true, "true"},
+		{map[string]string{"share": "myshare"}, `{"share":"myshare"}`},
+		{[]string{"a", "b"}, `["a","b"]`},
+	}
+	for _, c := range cases {
+		if got := journalFieldValue(c.v); got != c.want {
+			t.Errorf("%#v: got %q, want %q", c.v, got, c.want)
+		}
+	}
+}
+
+func TestJournaldHookFire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azurefile-journald")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := &net.UnixAddr{Name: filepath.Join(dir, "socket"), Net: "unixgram"}
+	journal, err := net.ListenUnixgram("unixgram", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	h := &journaldHook{conn}
+	entry := log.NewEntry(log.New()).WithFields(log.Fields{
+		"operation": "mount",
+		"name":      "myvol",
+		"message":   "shadowed",
+		"error":     errors.New("exit status 32\noutput=denied"),
+	})
+	entry.Level = log.ErrorLevel
+	entry.Message = "mount failed"
+	if err := h.Fire(entry); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	n, err := journal.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := string(buf[:n])
+	for _, want := range []string{
+		"MESSAGE=mount failed\n",
+		"PRIORITY=3\n",
+		"SYSLOG_IDENTIFIER=azurefile-dockervolumedriver\n",
+		"ERROR\n\x1c\x00\x00\x00\x00\x00\x00\x00exit status 32\noutput=denied\n",
+		"FIELD_MESSAGE=shadowed\n",
+		"NAME=myvol\n",
+		"OPERATION=mount\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("datagram %q does not contain %q", got, want)
+		}
+	}
+}
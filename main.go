@@ -2,6 +2,8 @@ package main
 
 import (
 	"os"
+	"path/filepath"
+	"time"
 
 	azure "github.com/Azure/azure-sdk-for-go/storage"
 	log "github.com/Sirupsen/logrus"
@@ -13,6 +15,14 @@ const (
 	volumeDriverName = "azurefile"
 	mountpoint       = "/var/run/docker/volumedriver/azurefile"
 	metadataRoot     = "/etc/docker/plugins/azurefile/volumes"
+
+	defaultMountTimeout = time.Minute
+
+	// pluginMountRoot is the propagated mount of the managed plugin (see
+	// contrib/plugin/config.json). Volumes are mounted under it so that the
+	// mounts are visible to the docker engine, and metadata is kept there
+	// since it survives plugin upgrades.
+	pluginMountRoot = "/mnt/azurefile"
 )
 
 var (
@@ -29,6 +39,7 @@ func main() {
 	cmd.Usage = "Docker Volume Driver for Azure File Service"
 	cli.AppHelpTemplate = usageTemplate
 
+	cmd.Commands = commands()
 	cmd.Flags = []cli.Flag{
 		cli.StringFlag{
 			Name:   "account-name",
@@ -46,54 +57,289 @@ func main() {
 			EnvVar: "AZURE_STORAGE_BASE",
 			Value:  azure.DefaultBaseURL,
 		},
+		cli.StringFlag{
+			Name:   "file-endpoint",
+			Usage:  "Azure File Service endpoint URL, overrides --storage-base (e.g. http://127.0.0.1:10004/devstoreaccount1 for an emulator)",
+			EnvVar: "AZURE_STORAGE_FILE_ENDPOINT",
+		},
+		cli.BoolFlag{
+			Name:   "remove-shares",
+			Usage:  "remove associated Azure File Share when volume is removed",
+			EnvVar: "REMOVE_SHARES",
+		},
 		cli.BoolFlag{
-			Name:  "remove-shares",
-			Usage: "remove associated Azure File Share when volume is removed",
+			Name:   "remove-subdirs",
+			Usage:  "remove the directory of subdirectory volumes when volume is removed",
+			EnvVar: "REMOVE_SUBDIRS",
+		},
+		cli.StringFlag{
+			Name:   "subdir-share",
+			Usage:  "Azure File Share used for subdirectory volumes created without 'share' option",
+			EnvVar: "SUBDIR_SHARE",
 		},
 		cli.BoolFlag{
 			Name:   "debug",
-			Usage:  "Enable verbose logging",
+			Usage:  "Enable verbose logging (same as --log-level=debug)",
 			EnvVar: "DEBUG",
 		},
+		cli.StringFlag{
+			Name:   "log-level",
+			Usage:  "Minimum level of log entries: debug, info, warn or error",
+			Value:  "info",
+			EnvVar: "LOG_LEVEL",
+		},
+		cli.StringFlag{
+			Name:   "log-format",
+			Usage:  "Format of log entries: text or json",
+			Value:  logFormatText,
+			EnvVar: "LOG_FORMAT",
+		},
+		cli.StringFlag{
+			Name:   "log-sink",
+			Usage:  "Where log entries are written: stderr, journald or syslog",
+			Value:  logSinkStderr,
+			EnvVar: "LOG_SINK",
+		},
 		cli.StringFlag{
 			Name:  "mountpoint",
 			Usage: "Host path where volumes are mounted at",
 			Value: mountpoint,
 		},
+		cli.StringFlag{
+			Name:   "share-name-template",
+			Usage:  "Template for share names of volumes created without 'share' option (fields: {{.Name}}, {{.Hash}})",
+			Value:  defaultShareNameTemplate,
+			EnvVar: "SHARE_NAME_TEMPLATE",
+		},
+		cli.DurationFlag{
+			Name:   "mount-timeout",
+			Usage:  "Maximum time a volume mount may take (0 for no limit)",
+			Value:  defaultMountTimeout,
+			EnvVar: "MOUNT_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "trace-file",
+			Usage:  "Append trace spans of plugin requests to the file as JSON lines",
+			EnvVar: "TRACE_FILE",
+		},
+		cli.StringFlag{
+			Name:   "otlp-endpoint",
+			Usage:  "Export trace spans of plugin requests to the OpenTelemetry collector (OTLP/HTTP, e.g. http://localhost:4318)",
+			EnvVar: "OTEL_EXPORTER_OTLP_ENDPOINT",
+		},
+		cli.DurationFlag{
+			Name:   "shutdown-timeout",
+			Usage:  "Maximum time to wait for the volume operation in progress on SIGTERM/SIGINT (0 for no limit)",
+			Value:  defaultShutdownTimeout,
+			EnvVar: "SHUTDOWN_TIMEOUT",
+		},
+		cli.BoolFlag{
+			Name:   "unmount-on-exit",
+			Usage:  "Unmount all volumes when the driver is stopped",
+			EnvVar: "UNMOUNT_ON_EXIT",
+		},
+		cli.StringFlag{
+			Name:   "policy",
+			Usage:  "JSON file with the policy restricting the volumes that can be created",
+			EnvVar: "POLICY_FILE",
+		},
 		cli.StringFlag{
 			Name:  "metadata",
 			Usage: "Path where volume metadata are stored",
 			Value: metadataRoot,
 		},
+		cli.StringFlag{
+			Name:  "socket",
+			Usage: "Path of the plugin API unix socket (default: " + pluginSockDir + "/" + volumeDriverName + ".sock)",
+		},
+		cli.StringFlag{
+			Name:  "socket-group",
+			Usage: "Group (name or ID) owning the plugin API unix socket, empty to leave unchanged",
+			Value: defaultSocketGroup,
+		},
+		cli.StringFlag{
+			Name:  "socket-mode",
+			Usage: "Permission mode of the plugin API unix socket",
+			Value: defaultSocketMode,
+		},
+		cli.StringFlag{
+			Name:  "tcp",
+			Usage: "Serve the plugin API on the TCP address (host:port) instead of the unix socket",
+		},
+		cli.StringFlag{
+			Name:  "tcp-advertise",
+			Usage: "Address (host:port) the docker engine connects to, written to the plugin discovery file (defaults to the --tcp address)",
+		},
+		cli.StringFlag{
+			Name:  "tls-cert",
+			Usage: "TLS certificate for the TCP listener",
+		},
+		cli.StringFlag{
+			Name:  "tls-key",
+			Usage: "TLS key for the TCP listener",
+		},
+		cli.StringFlag{
+			Name:  "tls-ca",
+			Usage: "CA certificates to verify docker engine client certificates with (enables mutual TLS)",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-cert",
+			Usage: "Client certificate for the docker engine, written to the plugin discovery file",
+		},
+		cli.StringFlag{
+			Name:  "tls-client-key",
+			Usage: "Client key for the docker engine, written to the plugin discovery file",
+		},
+		cli.StringFlag{
+			Name:  "plugin-spec-dir",
+			Usage: "Directory the plugin discovery file for the TCP listener is written to",
+			Value: pluginSpecDir,
+		},
+		cli.BoolFlag{
+			Name:  "plugin",
+			Usage: "Run as a Docker managed plugin (volumes and metadata under " + pluginMountRoot + ")",
+		},
+	}
+	cmd.Before = func(c *cli.Context) error {
+		cfg := logConfig{
+			Format: c.GlobalString("log-format"),
+			Level:  c.GlobalString("log-level"),
+			Sink:   c.GlobalString("log-sink"),
+		}
+		if c.GlobalBool("debug") {
+			cfg.Level = "debug"
+		}
+		if err := setupLogging(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return nil
 	}
 	cmd.Action = func(c *cli.Context) {
-		if c.Bool("debug") {
-			log.SetLevel(log.DebugLevel)
+		cfg := driverConfig{
+			AccountName:       c.String("account-name"),
+			AccountKey:        c.String("account-key"),
+			StorageBase:       c.String("storage-base"),
+			FileEndpoint:      c.String("file-endpoint"),
+			Mountpoint:        c.String("mountpoint"),
+			MetadataRoot:      c.String("metadata"),
+			ShareNameTemplate: c.String("share-name-template"),
+			SubdirShare:       c.String("subdir-share"),
+			RemoveShares:      c.Bool("remove-shares"),
+			RemoveSubdirs:     c.Bool("remove-subdirs"),
+			MountTimeout:      c.Duration("mount-timeout"),
 		}
-
-		accountName := c.String("account-name")
-		accountKey := c.String("account-key")
-		storageBase := c.String("storage-base")
-		mountpoint := c.String("mountpoint")
-		metaDir := c.String("metadata")
-		removeShares := c.Bool("remove-shares")
-		if accountName == "" || accountKey == "" {
+		unix := unixConfig{
+			Path:  c.String("socket"),
+			Group: c.String("socket-group"),
+			Mode:  c.String("socket-mode"),
+		}
+		if c.Bool("plugin") {
+			// The plugin runtime reads the socket from inside the plugin's
+			// rootfs as root and there is no docker group in there.
+			if !c.IsSet("socket-group") {
+				unix.Group = ""
+			}
+			if !c.IsSet("mountpoint") {
+				cfg.Mountpoint = filepath.Join(pluginMountRoot, "volumes")
+			}
+			if !c.IsSet("metadata") {
+				cfg.MetadataRoot = filepath.Join(pluginMountRoot, "metadata")
+			}
+		} else if !c.IsSet("socket-group") {
+			if _, err := lookupGroupID(unix.Group); err != nil {
+				log.Warnf("default socket group %q not found, leaving socket group unchanged", unix.Group)
+				unix.Group = ""
+			}
+		}
+		if cfg.AccountName == "" || cfg.AccountKey == "" {
 			log.Fatal("azure storage account name and key must be provided.")
 		}
+		if file := c.String("policy"); file != "" {
+			p, err := loadPolicy(file)
+			if err != nil {
+				log.Fatal(err)
+			}
+			cfg.Policy = p
+		}
+
+		tcp := tcpConfig{
+			Addr:           c.String("tcp"),
+			AdvertiseAddr:  c.String("tcp-advertise"),
+			CertFile:       c.String("tls-cert"),
+			KeyFile:        c.String("tls-key"),
+			CAFile:         c.String("tls-ca"),
+			ClientCertFile: c.String("tls-client-cert"),
+			ClientKeyFile:  c.String("tls-client-key"),
+			SpecDir:        c.String("plugin-spec-dir"),
+		}
+		if tcp.Addr != "" {
+			if err := tcp.validate(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		shutdown := shutdownConfig{
+			Timeout:    c.Duration("shutdown-timeout"),
+			UnmountAll: c.Bool("unmount-on-exit"),
+		}
 
 		log.WithFields(log.Fields{
-			"accountName":  accountName,
-			"metadata":     metaDir,
-			"mountpoint":   mountpoint,
-			"removeShares": removeShares,
+			"accountName":   cfg.AccountName,
+			"metadata":      cfg.MetadataRoot,
+			"mountpoint":    cfg.Mountpoint,
+			"removeShares":  cfg.RemoveShares,
+			"removeSubdirs": cfg.RemoveSubdirs,
 		}).Debug("Starting server.")
 
-		driver, err := newVolumeDriver(accountName, accountKey, storageBase, mountpoint, metaDir, removeShares)
+		if err := setupTracing(c.String("trace-file"), c.String("otlp-endpoint")); err != nil {
+			log.Fatal(err)
+		}
+
+		driver, err := newVolumeDriver(cfg)
 		if err != nil {
 			log.Fatal(err)
 		}
+		vols, err := driver.meta.List(log.WithField("operation", "startup"))
+		if err != nil {
+			log.Fatalf("cannot load volume metadata: %v", err)
+		}
+		log.WithField("volumes", len(vols)).Debug("Loaded volume metadata.")
 		h := volume.NewHandler(driver)
-		log.Fatal(h.ServeUnix("docker", volumeDriverName))
+		if tcp.Addr == "" {
+			l, err := newUnixListener(volumeDriverName, unix)
+			if err != nil {
+				log.Fatalf("cannot serve plugin API: %v", err)
+			}
+			log.WithFields(log.Fields{
+				"addr": l.Addr().String(),
+			}).Info("Serving plugin API on unix socket.")
+			if err := serve(h, l, driver, shutdown); err != nil {
+				log.Fatalf("plugin API server stopped: %v", err)
+			}
+			if defaultTracer != nil {
+				defaultTracer.Close()
+			}
+			log.Info("Driver stopped.")
+			return
+		}
+
+		l, spec, err := newTCPListener(volumeDriverName, tcp)
+		if err != nil {
+			log.Fatalf("cannot serve plugin API: %v", err)
+		}
+		log.WithFields(log.Fields{
+			"addr": l.Addr().String(),
+			"tls":  tcp.tlsEnabled(),
+			"spec": spec,
+		}).Info("Serving plugin API over TCP.")
+		err = serve(h, l, driver, shutdown)
+		os.Remove(spec)
+		if err != nil {
+			log.Fatalf("plugin API server stopped: %v", err)
+		}
+		if defaultTracer != nil {
+			defaultTracer.Close()
+		}
+		log.Info("Driver stopped.")
 	}
 	cmd.Run(os.Args)
 }
@@ -2,21 +2,39 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
+// quarantineDir is the directory under the metadata directory where corrupt
+// metadata records are moved to.
+const quarantineDir = ".quarantine"
+
+var errVolumeNotFound = errors.New("volume not found")
+
 var (
-	recognizedOptions = []string{"share", "filemode", "dirmode", "uid", "gid", "nolock", "remotepath"}
+	recognizedOptions = []string{"share", "filemode", "dirmode", "uid", "gid", "nolock", "remotepath",
+		"vers", "cache", "actimeo", "serverino", "mfsymlinks", "nobrl", "seal", "ro", "subdir",
+		"removepolicy", "quota"}
 )
 
 type volumeMetadata struct {
+	Version   int           `json:"version"`
 	CreatedAt time.Time     `json:"created_at"`
 	Account   string        `json:"account"`
 	Options   VolumeOptions `json:"options"`
+
+	// Labels are the user labels of the volume, passed as label.<key>
+	// options.
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // VolumeOptions stores the opts passed to the driver by the docker engine.
@@ -28,6 +46,29 @@ type VolumeOptions struct {
 	GID        string `json:"gid"`
 	NoLock     bool   `json:"nolock"`
 	RemotePath string `json:"remotepath"`
+
+	// Additional mount.cifs options. Empty values mean the mount helper
+	// defaults are used.
+	Vers       string `json:"vers,omitempty"`
+	Cache      string `json:"cache,omitempty"`
+	ActimeO    string `json:"actimeo,omitempty"`
+	ServerIno  *bool  `json:"serverino,omitempty"`
+	MFSymlinks bool   `json:"mfsymlinks,omitempty"`
+	NoBRL      bool   `json:"nobrl,omitempty"`
+	Seal       bool   `json:"seal,omitempty"`
+	ReadOnly   bool   `json:"ro,omitempty"`
+
+	// Subdir marks volumes that live in the RemotePath directory of a share
+	// shared with other volumes, rather than owning the share.
+	Subdir bool `json:"subdir,omitempty"`
+
+	// RemovePolicy decides what happens to the volume data when the volume
+	// is removed. Empty means the daemon-wide default applies.
+	RemovePolicy string `json:"removepolicy,omitempty"`
+
+	// Quota is the size limit of the share in GiB, zero leaves the share's
+	// quota unchanged.
+	Quota int `json:"quota,omitempty"`
 }
 
 type metadataDriver struct {
@@ -43,10 +84,12 @@ func newMetadataDriver(metaDir string) (*metadataDriver, error) {
 
 func (m *metadataDriver) Validate(meta map[string]string) (volumeMetadata, error) {
 	var v volumeMetadata
-	var opts VolumeOptions
 
 	// Validate keys
 	for k := range meta {
+		if isLabelOption(k) {
+			continue
+		}
 		found := false
 		for _, opts := range recognizedOptions {
 			if k == opts {
@@ -58,53 +101,178 @@ func (m *metadataDriver) Validate(meta map[string]string) (volumeMetadata, error
 			return v, fmt.Errorf("not a recognized volume driver option: %q", k)
 		}
 	}
-	opts.Share = meta["share"]
-	opts.DirMode = meta["dirmode"]
-	opts.FileMode = meta["filemode"]
-	opts.GID = meta["gid"]
-	opts.UID = meta["uid"]
-	opts.RemotePath = meta["remotepath"]
-
-	if meta["nolock"] == "true" {
-		opts.NoLock = true
+	opts, err := parseVolumeOptions(meta)
+	if err != nil {
+		return v, err
+	}
+	labels, err := parseLabels(meta)
+	if err != nil {
+		return v, err
 	}
 
 	return volumeMetadata{
 		Options: opts,
+		Labels:  labels,
 	}, nil
 }
 
+// optionMap returns the volume options and labels of a record in the form
+// docker passes them on create, so that a record from elsewhere can be run
+// through Validate.
+func (v volumeMetadata) optionMap() map[string]string {
+	o := v.Options
+	meta := make(map[string]string)
+	for _, s := range []struct{ name, value string }{
+		{"share", o.Share},
+		{"filemode", o.FileMode},
+		{"dirmode", o.DirMode},
+		{"uid", o.UID},
+		{"gid", o.GID},
+		{"remotepath", o.RemotePath},
+		{"vers", o.Vers},
+		{"cache", o.Cache},
+		{"actimeo", o.ActimeO},
+		{"removepolicy", o.RemovePolicy},
+	} {
+		if s.value != "" {
+			meta[s.name] = s.value
+		}
+	}
+	for _, f := range []struct {
+		name  string
+		value bool
+	}{
+		{"nolock", o.NoLock},
+		{"mfsymlinks", o.MFSymlinks},
+		{"nobrl", o.NoBRL},
+		{"seal", o.Seal},
+		{"ro", o.ReadOnly},
+		{"subdir", o.Subdir},
+	} {
+		if f.value {
+			meta[f.name] = "true"
+		}
+	}
+	if o.ServerIno != nil {
+		meta["serverino"] = strconv.FormatBool(*o.ServerIno)
+	}
+	if o.Quota != 0 {
+		meta["quota"] = strconv.Itoa(o.Quota)
+	}
+	for k, val := range v.Labels {
+		meta[labelOptionPrefix+k] = val
+	}
+	return meta
+}
+
 func (m *metadataDriver) Delete(name string) error {
-	if err := os.RemoveAll(m.path(name)); err != nil {
+	path, err := m.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("cannot delete volume metadata: %v", err)
 	}
 	return nil
 }
 
 func (m *metadataDriver) Set(name string, meta volumeMetadata) error {
+	path, err := m.path(name)
+	if err != nil {
+		return err
+	}
+	meta.Version = metadataVersion
 	b, err := json.Marshal(meta)
 	if err != nil {
 		return fmt.Errorf("cannot serialize metadata: %v", err)
 	}
-	if err := ioutil.WriteFile(m.path(name), b, 0600); err != nil {
+	if err := writeFileAtomic(path, b, 0600); err != nil {
 		return fmt.Errorf("cannot write metadata: %v", err)
 	}
 	return nil
 }
 
-func (m *metadataDriver) Get(name string) (volumeMetadata, error) {
+// Exists reports whether there is a metadata record for the volume, readable
+// or not. Unlike Get, it never moves corrupt records to the quarantine.
+func (m *metadataDriver) Exists(name string) (bool, error) {
+	path, err := m.path(name)
+	if err != nil {
+		return false, err
+	}
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("cannot check metadata: %v", err)
+	}
+	return true, nil
+}
+
+// Get reads the metadata of a volume. Returns errVolumeNotFound if there is
+// no metadata for the volume. Corrupt records are moved to the quarantine
+// directory and reported as an error.
+func (m *metadataDriver) Get(logctx *log.Entry, name string) (volumeMetadata, error) {
 	var v volumeMetadata
-	b, err := ioutil.ReadFile(m.path(name))
+	path, err := m.path(name)
 	if err != nil {
+		return v, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return v, errVolumeNotFound
+		}
 		return v, fmt.Errorf("cannot read metadata: %v", err)
 	}
-	if err := json.Unmarshal(b, &v); err != nil {
-		return v, fmt.Errorf("cannot deserialize metadata: %v", err)
+	v, _, err = decodeMetadata(logctx, b)
+	if _, ok := err.(corruptMetadataError); ok {
+		if qerr := m.quarantine(name); qerr != nil {
+			return v, fmt.Errorf("%v (%v)", err, qerr)
+		}
+		return v, fmt.Errorf("%v, moved to %s", err, filepath.Join(m.metaDir, quarantineDir))
 	}
-	return v, nil
+	return v, err
 }
 
-func (m *metadataDriver) List() ([]string, error) {
+// Migrate upgrades the stored metadata records of older schema versions to
+// the current version and returns the names of the upgraded volumes. With
+// dryRun, nothing is written.
+func (m *metadataDriver) Migrate(logctx *log.Entry, dryRun bool) ([]string, error) {
+	vols, err := m.List(logctx)
+	if err != nil {
+		return nil, err
+	}
+	var migrated []string
+	for _, name := range vols {
+		path, err := m.path(name)
+		if err != nil {
+			return migrated, err
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return migrated, fmt.Errorf("cannot read metadata of volume %q: %v", name, err)
+		}
+		v, upgraded, err := decodeMetadata(logctx.WithField("name", name), b)
+		if err != nil {
+			return migrated, fmt.Errorf("volume %q: %v", name, err)
+		}
+		if !upgraded {
+			continue
+		}
+		if !dryRun {
+			if err := m.Set(name, v); err != nil {
+				return migrated, fmt.Errorf("volume %q: %v", name, err)
+			}
+		}
+		migrated = append(migrated, name)
+	}
+	return migrated, nil
+}
+
+// List returns the names of the volumes with metadata. Corrupt records are
+// moved to the quarantine directory and left out instead of failing the
+// whole listing.
+func (m *metadataDriver) List(logctx *log.Entry) ([]string, error) {
 	var volumes []string
 
 	// return all the file names under metadata directory
@@ -117,12 +285,33 @@ func (m *metadataDriver) List() ([]string, error) {
 			return nil
 		}
 
-		if info.IsDir() { // a directory
+		if info.IsDir() { // a directory, including the quarantine
 			return filepath.SkipDir
 		}
 
-		// base file name indicates the volume name
-		volumes = append(volumes, filepath.Base(path))
+		// base file name indicates the (encoded) volume name, temporary
+		// files of interrupted writes start with a dot
+		base := filepath.Base(path)
+		if strings.HasPrefix(base, ".") {
+			return nil
+		}
+		name, err := decodeVolumeName(base)
+		if err != nil {
+			logctx.Warnf("ignoring file in metadata directory: %v", err)
+			return nil
+		}
+		if b, err := ioutil.ReadFile(path); err == nil {
+			if _, _, err := decodeMetadata(logctx.WithField("name", name), b); err != nil {
+				if _, ok := err.(corruptMetadataError); ok {
+					logctx.Warnf("metadata of volume %q is corrupt, moving it to quarantine: %v", name, err)
+					if err := m.quarantine(name); err != nil {
+						logctx.Error(err)
+					}
+					return nil
+				}
+			}
+		}
+		volumes = append(volumes, name)
 		return nil
 	}); err != nil {
 		return volumes, fmt.Errorf("cannot list directory: %v", err)
@@ -130,6 +319,89 @@ func (m *metadataDriver) List() ([]string, error) {
 	return volumes, nil
 }
 
-func (m *metadataDriver) path(name string) string {
-	return filepath.Join(m.metaDir, name)
+// quarantine moves the metadata record of a volume out of the way, keeping
+// it for inspection under the quarantine directory.
+func (m *metadataDriver) quarantine(name string) error {
+	path, err := m.path(name)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Join(m.metaDir, quarantineDir)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("cannot create quarantine directory: %v", err)
+	}
+	dst := filepath.Join(dir, fmt.Sprintf("%s.%s", encodeVolumeName(name), time.Now().UTC().Format("20060102T150405Z")))
+	if err := os.Rename(path, dst); err != nil {
+		return fmt.Errorf("cannot quarantine metadata of volume %q: %v", name, err)
+	}
+	return nil
+}
+
+// References returns the names of the volumes whose metadata refer to the
+// specified Azure File share. Records that cannot be read are skipped, so
+// that one bad record does not block operations on every other volume.
+func (m *metadataDriver) References(logctx *log.Entry, share string) ([]string, error) {
+	vols, err := m.List(logctx)
+	if err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, name := range vols {
+		meta, err := m.Get(logctx, name)
+		if err != nil {
+			logctx.Warnf("ignoring volume %q when checking references to share %q: %v", name, share, err)
+			continue
+		}
+		if meta.Options.Share == share {
+			refs = append(refs, name)
+		}
+	}
+	return refs, nil
+}
+
+func (m *metadataDriver) path(name string) (string, error) {
+	return volumePath(m.metaDir, name)
+}
+
+// writeFileAtomic writes data to a temporary file next to filename and
+// renames it into place once it is synced to disk, so that a crash or a full
+// disk never leaves a truncated file behind.
+func writeFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(filename)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// sync the directory for the rename to be durable
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
 }
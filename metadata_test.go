@@ -0,0 +1,125 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func testMetadataDriver(t *testing.T) (*metadataDriver, func()) {
+	dir, err := ioutil.TempDir("", "azurefile-metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := newMetadataDriver(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return m, func() { os.RemoveAll(dir) }
+}
+
+func writeRecord(t *testing.T, m *metadataDriver, file, record string) {
+	if err := ioutil.WriteFile(filepath.Join(m.metaDir, file), []byte(record), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReferencesSkipsUnreadableRecords(t *testing.T) {
+	m, cleanup := testMetadataDriver(t)
+	defer cleanup()
+
+	writeRecord(t, m, "vol1", `{"options":{"share":"myshare"}}`)
+	writeRecord(t, m, "vol2", `{"version":2,"options":{"share":"myshare","filemode":"0644"}}`)
+	writeRecord(t, m, "vol3", `{"options":{"share":"myshare","filemode":"rwx"}}`)
+	writeRecord(t, m, "vol4", `{"version":3,"options":{"share":"myshare"}}`)
+	writeRecord(t, m, "vol5", `{"version":2,"options":{"share":"othershare"}}`)
+
+	refs, err := m.References(log.NewEntry(log.StandardLogger()), "myshare")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(refs)
+	if want := []string{"vol1", "vol2", "vol3"}; !reflect.DeepEqual(refs, want) {
+		t.Errorf("got %v, want %v", refs, want)
+	}
+}
+
+// quarantined returns the names of the files in the quarantine directory.
+func quarantined(t *testing.T, m *metadataDriver) []string {
+	fis, err := ioutil.ReadDir(filepath.Join(m.metaDir, quarantineDir))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range fis {
+		names = append(names, fi.Name())
+	}
+	return names
+}
+
+func TestListQuarantinesCorruptRecords(t *testing.T) {
+	m, cleanup := testMetadataDriver(t)
+	defer cleanup()
+
+	writeRecord(t, m, "good", `{"version":2,"options":{"share":"myshare"}}`)
+	writeRecord(t, m, "newer", `{"version":3,"options":{"share":"myshare"}}`)
+	writeRecord(t, m, "truncated", `{"version":2,"opt`)
+	writeRecord(t, m, "empty", ``)
+	writeRecord(t, m, ".good.tmp", `{"version":2,"opt`)
+	writeRecord(t, m, "not%zzencoded", `{"version":2}`)
+
+	vols, err := m.List(log.NewEntry(log.StandardLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(vols)
+	if want := []string{"good", "newer"}; !reflect.DeepEqual(vols, want) {
+		t.Errorf("got volumes %v, want %v", vols, want)
+	}
+
+	q := quarantined(t, m)
+	if len(q) != 2 || !strings.HasPrefix(q[0], "empty.") || !strings.HasPrefix(q[1], "truncated.") {
+		t.Errorf("got quarantine %v, want the empty and truncated records", q)
+	}
+	// records that are valid JSON but cannot be read, and files that are
+	// not records, stay where they are
+	for _, f := range []string{"newer", ".good.tmp", "not%zzencoded"} {
+		if _, err := os.Stat(filepath.Join(m.metaDir, f)); err != nil {
+			t.Errorf("%s: %v", f, err)
+		}
+	}
+}
+
+func TestGetQuarantinesCorruptRecord(t *testing.T) {
+	m, cleanup := testMetadataDriver(t)
+	defer cleanup()
+	logctx := log.NewEntry(log.StandardLogger())
+
+	writeRecord(t, m, "truncated", `{"version":2,"opt`)
+	writeRecord(t, m, "newer", `{"version":3,"options":{"share":"myshare"}}`)
+
+	_, err := m.Get(logctx, "truncated")
+	if err == nil || !strings.Contains(err.Error(), "moved to "+filepath.Join(m.metaDir, quarantineDir)) {
+		t.Errorf("got error %v, want record moved to quarantine", err)
+	}
+	if q := quarantined(t, m); len(q) != 1 || !strings.HasPrefix(q[0], "truncated.") {
+		t.Errorf("got quarantine %v", q)
+	}
+	if _, err := m.Get(logctx, "truncated"); err != errVolumeNotFound {
+		t.Errorf("got error %v after quarantine, want %v", err, errVolumeNotFound)
+	}
+
+	if _, err := m.Get(logctx, "newer"); err == nil || !strings.Contains(err.Error(), "newer than supported") {
+		t.Errorf("got error %v, want version error", err)
+	}
+	if ok, _ := m.Exists("newer"); !ok {
+		t.Error("record of a newer version moved")
+	}
+}
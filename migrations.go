@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// metadataVersion is the schema version of the volume metadata records
+// written by this version of the driver.
+//
+// Version 1 records have no 'version' field. They were written up to 0.5.x,
+// before volume options were strictly validated, so modes and paths are
+// stored as the user gave them. Version 2 adds 'version', stores 'filemode'
+// and 'dirmode' as canonical 4-digit octal and 'remotepath' without leading
+// or trailing slashes.
+const metadataVersion = 2
+
+// metadataMigrations upgrade raw metadata records one version at a time:
+// metadataMigrations[i] turns a version i+1 record into a version i+2 record.
+// Records are handled as decoded JSON objects so that migrations can deal
+// with fields and shapes the current volumeMetadata type no longer has.
+var metadataMigrations = []func(logctx *log.Entry, rec map[string]interface{}) error{
+	migrateV1ToV2,
+}
+
+// corruptMetadataError is returned for metadata records that are not valid
+// JSON, such as files truncated by an interrupted write.
+type corruptMetadataError struct {
+	err error
+}
+
+func (e corruptMetadataError) Error() string {
+	return fmt.Sprintf("cannot deserialize metadata: %v", e.err)
+}
+
+// decodeMetadata parses a metadata record of any known schema version and
+// upgrades it to the current version. Returns whether the record was
+// upgraded, in which case it should be written back.
+func decodeMetadata(logctx *log.Entry, b []byte) (volumeMetadata, bool, error) {
+	var v volumeMetadata
+	var rec map[string]interface{}
+	if err := json.Unmarshal(b, &rec); err != nil {
+		return v, false, corruptMetadataError{err}
+	}
+
+	version := 1
+	if raw, ok := rec["version"]; ok {
+		n, ok := raw.(float64)
+		if !ok || n < 1 || n != float64(int(n)) {
+			return v, false, fmt.Errorf("invalid metadata version: %v", raw)
+		}
+		version = int(n)
+	}
+	if version > metadataVersion {
+		return v, false, fmt.Errorf("metadata version %d is newer than supported version %d, upgrade the driver", version, metadataVersion)
+	}
+
+	upgraded := version < metadataVersion
+	for ; version < metadataVersion; version++ {
+		if err := metadataMigrations[version-1](logctx, rec); err != nil {
+			return v, false, fmt.Errorf("cannot migrate metadata from version %d to %d: %v", version, version+1, err)
+		}
+		rec["version"] = version + 1
+	}
+
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return v, false, fmt.Errorf("cannot serialize migrated metadata: %v", err)
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return v, false, fmt.Errorf("cannot deserialize metadata: %v", err)
+	}
+	return v, upgraded, nil
+}
+
+// migrateV1ToV2 normalizes the option values which were stored verbatim
+// before the options were validated on volume creation. Modes that cannot be
+// parsed are kept as they are, so that the volume can still be inspected and
+// removed; mounting it fails instead (see checkStoredOptions).
+func migrateV1ToV2(logctx *log.Entry, rec map[string]interface{}) error {
+	opts, ok := rec["options"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	for _, k := range []string{"filemode", "dirmode"} {
+		s, _ := opts[k].(string)
+		if s == "" {
+			continue
+		}
+		mode, err := parseMode(s)
+		if err != nil {
+			logctx.Warnf("keeping invalid option '%s' of metadata record unchanged: %v", k, err)
+			continue
+		}
+		opts[k] = mode
+	}
+	if s, _ := opts["remotepath"].(string); s != "" {
+		opts["remotepath"] = strings.Trim(s, "/")
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func TestDecodeMetadata(t *testing.T) {
+	created := time.Date(2016, 11, 2, 10, 4, 5, 0, time.UTC)
+	yes := true
+	cases := []struct {
+		name     string
+		record   string
+		want     volumeMetadata
+		upgraded bool
+		err      string
+	}{
+		{
+			name: "version 1, baseline",
+			record: `{"created_at":"2016-11-02T10:04:05Z","account":"acct",` +
+				`"options":{"share":"myshare","filemode":"777","dirmode":"0755","uid":"1000","gid":"",` +
+				`"nolock":true,"remotepath":"/data/dir/"}}`,
+			want: volumeMetadata{Version: 2, CreatedAt: created, Account: "acct", Options: VolumeOptions{
+				Share: "myshare", FileMode: "0777", DirMode: "0755", UID: "1000", NoLock: true, RemotePath: "data/dir"}},
+			upgraded: true,
+		},
+		{
+			name: "version 1, with mount options, subdir volumes and removal policy",
+			record: `{"created_at":"2016-11-02T10:04:05Z","account":"acct",` +
+				`"options":{"share":"shared","filemode":"","dirmode":"","uid":"","gid":"","nolock":false,` +
+				`"remotepath":"vol1","vers":"3.0","cache":"none","actimeo":"30","serverino":true,` +
+				`"mfsymlinks":true,"nobrl":true,"seal":true,"ro":true,"subdir":true,"removepolicy":"snapshot-then-delete"}}`,
+			want: volumeMetadata{Version: 2, CreatedAt: created, Account: "acct", Options: VolumeOptions{
+				Share: "shared", RemotePath: "vol1", Vers: "3.0", Cache: "none", ActimeO: "30", ServerIno: &yes,
+				MFSymlinks: true, NoBRL: true, Seal: true, ReadOnly: true, Subdir: true, RemovePolicy: "snapshot-then-delete"}},
+			upgraded: true,
+		},
+		{
+			name: "version 1, invalid modes are kept",
+			record: `{"created_at":"2016-11-02T10:04:05Z","account":"acct",` +
+				`"options":{"share":"myshare","filemode":"rwx","dirmode":"0755,uid=0"}}`,
+			want: volumeMetadata{Version: 2, CreatedAt: created, Account: "acct", Options: VolumeOptions{
+				Share: "myshare", FileMode: "rwx", DirMode: "0755,uid=0"}},
+			upgraded: true,
+		},
+		{
+			name:     "version 1, no options",
+			record:   `{"created_at":"2016-11-02T10:04:05Z","account":"acct"}`,
+			want:     volumeMetadata{Version: 2, CreatedAt: created, Account: "acct"},
+			upgraded: true,
+		},
+		{
+			name: "version 2",
+			record: `{"version":2,"created_at":"2016-11-02T10:04:05Z","account":"acct",` +
+				`"options":{"share":"myshare","filemode":"0644","dirmode":"","uid":"","gid":"","nolock":false,` +
+				`"remotepath":"","quota":100},"labels":{"com.example.team":"infra"}}`,
+			want: volumeMetadata{Version: 2, CreatedAt: created, Account: "acct",
+				Options: VolumeOptions{Share: "myshare", FileMode: "0644", Quota: 100},
+				Labels:  map[string]string{"com.example.team": "infra"}},
+		},
+		{
+			name:   "newer version",
+			record: `{"version":3,"created_at":"2016-11-02T10:04:05Z","account":"acct","options":{}}`,
+			err:    "metadata version 3 is newer than supported version 2",
+		},
+		{
+			name:   "invalid version",
+			record: `{"version":"2","account":"acct"}`,
+			err:    "invalid metadata version",
+		},
+		{
+			name:   "truncated",
+			record: `{"version":2,"created_at":"2016-11-02T10:04:05Z","acc`,
+			err:    "cannot deserialize metadata",
+		},
+		{
+			name:   "empty",
+			record: ``,
+			err:    "cannot deserialize metadata",
+		},
+	}
+	for _, c := range cases {
+		got, upgraded, err := decodeMetadata(log.NewEntry(log.StandardLogger()), []byte(c.record))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: got error %v, want %q", c.name, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+			continue
+		}
+		if upgraded != c.upgraded {
+			t.Errorf("%s: got upgraded=%v, want %v", c.name, upgraded, c.upgraded)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+	if _, _, err := decodeMetadata(log.NewEntry(log.StandardLogger()), []byte(`{"version":2,"acc`)); err != nil {
+		if _, ok := err.(corruptMetadataError); !ok {
+			t.Errorf("truncated record: got %T, want corruptMetadataError", err)
+		}
+	} else {
+		t.Error("truncated record: no error")
+	}
+}
+
+func TestCheckStoredOptions(t *testing.T) {
+	for _, o := range []VolumeOptions{
+		{},
+		{FileMode: "0644", DirMode: "0755", UID: "1000", GID: "www-data"},
+		{Vers: "3.1.1", Cache: "none", ActimeO: "30"},
+	} {
+		if err := checkStoredOptions(o); err != nil {
+			t.Errorf("%+v: %v", o, err)
+		}
+	}
+	for _, o := range []VolumeOptions{
+		{FileMode: "rwx"},
+		{DirMode: "0755,uid=0"},
+		{UID: "0,cred=/etc/x"},
+		{GID: "a b"},
+		{Vers: "3.0,ip=10.0.0.9"},
+		{Cache: "strict,sec=none"},
+		{ActimeO: "30,domain=evil"},
+		{ActimeO: "-1"},
+	} {
+		if err := checkStoredOptions(o); err == nil {
+			t.Errorf("%+v: accepted", o)
+		}
+	}
+}
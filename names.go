@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"unicode/utf8"
+)
+
+// maxVolumeNameLength is the maximum length of the encoded volume name, which
+// is used as a file name under the metadata and mountpoint directories.
+const maxVolumeNameLength = 255
+
+// validateVolumeName rejects volume names the driver cannot store safely.
+// Names with characters that are unsafe in file names (such as '/') are
+// allowed, as they are encoded by encodeVolumeName.
+func validateVolumeName(name string) error {
+	if name == "" {
+		return fmt.Errorf("volume name is empty")
+	}
+	if !utf8.ValidString(name) {
+		return fmt.Errorf("volume name %q is not valid UTF-8", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("volume name %q contains control characters", name)
+		}
+	}
+	if n := len(encodeVolumeName(name)); n > maxVolumeNameLength {
+		return fmt.Errorf("volume name %q is too long (%d bytes encoded, maximum is %d)", name, n, maxVolumeNameLength)
+	}
+	return nil
+}
+
+// encodeVolumeName returns the file name used for the volume. Letters,
+// digits, '-', '_' and '.' (except as the first character) are kept as-is,
+// so names valid for Docker's local driver map to themselves. Every other
+// byte is percent-encoded, which rules out path separators, '.' and '..'
+// and hidden files.
+func encodeVolumeName(name string) string {
+	b := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if isSafeNameByte(c) || (c == '.' && i > 0) {
+			b = append(b, c)
+		} else {
+			b = append(b, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(b)
+}
+
+// decodeVolumeName reverses encodeVolumeName.
+func decodeVolumeName(s string) (string, error) {
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid encoded volume name %q", s)
+		}
+		n, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid encoded volume name %q", s)
+		}
+		b = append(b, byte(n))
+		i += 2
+	}
+	name := string(b)
+	if encodeVolumeName(name) != s {
+		return "", fmt.Errorf("invalid encoded volume name %q", s)
+	}
+	return name, nil
+}
+
+func isSafeNameByte(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_'
+}
+
+// volumePath returns the path of the volume's file or directory under root.
+// Returns an error if the path would not be a direct child of root, which
+// encodeVolumeName rules out for every non-empty name.
+func volumePath(root, name string) (string, error) {
+	p := filepath.Join(root, encodeVolumeName(name))
+	if filepath.Dir(p) != filepath.Clean(root) {
+		return "", fmt.Errorf("volume name %q does not map to a path under %s", name, root)
+	}
+	return p, nil
+}
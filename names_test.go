@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncodeVolumeName(t *testing.T) {
+	cases := map[string]string{
+		"myvol":         "myvol",
+		"my_vol-1.data": "my_vol-1.data",
+		".":             "%2E",
+		"..":            "%2E.",
+		"...":           "%2E..",
+		".hidden":       "%2Ehidden",
+		"a/../b":        "a%2F..%2Fb",
+		"../../etc":     "%2E.%2F..%2Fetc",
+		"/abs":          "%2Fabs",
+		"%2F":           "%252F",
+		"a b":           "a%20b",
+		"a\x00b":        "a%00b",
+		"\xff\xfe":      "%FF%FE",
+		"volé":          "vol%C3%A9",
+	}
+	for name, want := range cases {
+		got := encodeVolumeName(name)
+		if got != want {
+			t.Errorf("encode %q: got %q, want %q", name, got, want)
+		}
+		if strings.Contains(got, "/") || got == "." || got == ".." || strings.HasPrefix(got, ".") {
+			t.Errorf("encode %q: %q is not a safe file name", name, got)
+		}
+		if dec, err := decodeVolumeName(got); err != nil || dec != name {
+			t.Errorf("decode %q: got %q, %v, want %q", got, dec, err, name)
+		}
+	}
+}
+
+func TestDecodeVolumeNameInvalid(t *testing.T) {
+	for _, s := range []string{
+		"%", // truncated escapes
+		"a%2",
+		"%zz", // not hex
+		"%-1",
+		"%2e.",    // lowercase hex, not the canonical encoding
+		"a%41",    // escaped safe byte
+		"..",      // raw dot-dot
+		".hidden", // raw leading dot
+		"a/b",     // raw separator
+		"a b",     // raw space
+	} {
+		if name, err := decodeVolumeName(s); err == nil {
+			t.Errorf("decode %q: accepted as %q", s, name)
+		}
+	}
+}
+
+func TestValidateVolumeName(t *testing.T) {
+	valid := []string{
+		"myvol",
+		".",
+		"..",
+		"a/../b",
+		"%2F",
+		".hidden",
+		"volé",
+		strings.Repeat("a", maxVolumeNameLength),
+		strings.Repeat("/", maxVolumeNameLength/3),
+	}
+	for _, name := range valid {
+		if err := validateVolumeName(name); err != nil {
+			t.Errorf("%q: %v", name, err)
+		}
+	}
+
+	invalid := map[string]string{
+		"":         "empty",
+		"a\x00b":   "control characters",
+		"a\nb":     "control characters",
+		"a\x7fb":   "control characters",
+		"\xff\xfe": "not valid UTF-8",
+		strings.Repeat("a", maxVolumeNameLength+1):   "too long",
+		strings.Repeat("/", maxVolumeNameLength/3+1): "too long",
+	}
+	for name, want := range invalid {
+		err := validateVolumeName(name)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %q", name, err, want)
+		}
+	}
+}
+
+func TestVolumePath(t *testing.T) {
+	root := filepath.Join("/var/lib/azurefile", "volumes")
+	for _, name := range []string{"myvol", ".", "..", "a/../b", "../../etc/passwd", "%2F", ".hidden", "a\x00b", "\xff"} {
+		p, err := volumePath(root, name)
+		if err != nil {
+			t.Errorf("%q: %v", name, err)
+			continue
+		}
+		if filepath.Dir(p) != root {
+			t.Errorf("%q: path %q is not directly under %q", name, p, root)
+		}
+		if want := filepath.Join(root, encodeVolumeName(name)); p != want {
+			t.Errorf("%q: got %q, want %q", name, p, want)
+		}
+	}
+	if p, err := volumePath(root, ""); err == nil {
+		t.Errorf("empty name: got %q", p)
+	}
+}
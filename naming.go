@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+const (
+	defaultShareNameTemplate = "docker-{{.Name}}-{{.Hash}}"
+
+	maxShareNameLength = 63
+	shortHashLength    = 8
+)
+
+// shareNameFields are the values available to share name templates.
+type shareNameFields struct {
+	// Name is the Docker volume name, sanitized to the characters allowed
+	// in share names. It may be truncated to fit the share name limit.
+	Name string
+
+	// Hash is a short hex hash of the Docker volume name, which keeps the
+	// generated names of similar volume names apart.
+	Hash string
+}
+
+// shareNamer generates Azure File share names for volumes created without
+// the 'share' option.
+type shareNamer struct {
+	tmpl *template.Template
+}
+
+func newShareNamer(tmpl string) (*shareNamer, error) {
+	t, err := template.New("share").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse share name template: %v", err)
+	}
+	n := &shareNamer{t}
+
+	// catch templates that can never produce a valid share name early
+	if _, err := n.Name("volume", 0); err != nil {
+		return nil, fmt.Errorf("invalid share name template %q: %v", tmpl, err)
+	}
+	return n, nil
+}
+
+// Name returns the share name for the volume. attempt is mixed into the hash
+// to produce an alternative name after a collision; 0 is the first choice.
+func (n *shareNamer) Name(volume string, attempt int) (string, error) {
+	seed := volume
+	if attempt > 0 {
+		seed = fmt.Sprintf("%s#%d", volume, attempt)
+	}
+	sum := sha1.Sum([]byte(seed))
+	f := shareNameFields{
+		Name: sanitizeShareName(volume),
+		Hash: hex.EncodeToString(sum[:])[:shortHashLength],
+	}
+
+	name, err := n.render(f)
+	if err != nil {
+		return "", err
+	}
+	if excess := len(name) - maxShareNameLength; excess > 0 && excess < len(f.Name) {
+		// shorten the volume name part to make the result fit
+		f.Name = strings.Trim(f.Name[:len(f.Name)-excess], "-")
+		if name, err = n.render(f); err != nil {
+			return "", err
+		}
+	}
+	name = sanitizeShareName(name)
+	if err := validateShareName(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (n *shareNamer) render(f shareNameFields) (string, error) {
+	var b bytes.Buffer
+	if err := n.tmpl.Execute(&b, f); err != nil {
+		return "", fmt.Errorf("cannot execute share name template: %v", err)
+	}
+	return b.String(), nil
+}
+
+// sanitizeShareName lowercases s and replaces every run of characters not
+// allowed in share names with a single hyphen.
+func sanitizeShareName(s string) string {
+	var b bytes.Buffer
+	hyphen := false
+	for _, r := range strings.ToLower(s) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			hyphen = false
+		} else if !hyphen && b.Len() > 0 {
+			b.WriteByte('-')
+			hyphen = true
+		}
+	}
+	return strings.TrimRight(b.String(), "-")
+}
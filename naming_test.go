@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestSanitizeShareName(t *testing.T) {
+	cases := map[string]string{
+		"myvol":           "myvol",
+		"My Volume_01":    "my-volume-01",
+		"--a..b--":        "a-b",
+		"app/data/../x":   "app-data-x",
+		"volé":            "vol",
+		"___":             "",
+		"docker-a--b-c-1": "docker-a-b-c-1",
+	}
+	for in, want := range cases {
+		if got := sanitizeShareName(in); got != want {
+			t.Errorf("%q: got %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestShareNamer(t *testing.T) {
+	n, err := newShareNamer(defaultShareNameTemplate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		volume  string
+		attempt int
+		want    string
+	}{
+		{"myvol", 0, "docker-myvol-d63aeb72"},
+		{"myvol", 1, "docker-myvol-999fbf9e"},
+		{"myvol", 2, "docker-myvol-b2bd85f4"},
+		{"My Volume_01", 0, "docker-my-volume-01-8ba0cdb0"},
+		// the volume name part is shortened to fit 63 characters
+		{strings.Repeat("a", 100), 0, "docker-" + strings.Repeat("a", 47) + "-7f900025"},
+	}
+	for _, c := range cases {
+		got, err := n.Name(c.volume, c.attempt)
+		if err != nil {
+			t.Errorf("%q attempt %d: %v", c.volume, c.attempt, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q attempt %d: got %q, want %q", c.volume, c.attempt, got, c.want)
+		}
+		if len(got) > maxShareNameLength {
+			t.Errorf("%q: %q is longer than %d characters", c.volume, got, maxShareNameLength)
+		}
+	}
+
+	// truncation does not leave a hyphen before the separator
+	got, err := n.Name(strings.Repeat("a", 46)+"-bbbb", 0)
+	if err != nil || strings.Contains(got, "--") {
+		t.Errorf("got %q, %v", got, err)
+	}
+}
+
+func TestNewShareNamerInvalid(t *testing.T) {
+	for tmpl, want := range map[string]string{
+		"{{.Name":                             "cannot parse share name template",
+		"{{.Owner}}-{{.Hash}}":                "cannot execute share name template",
+		"x":                                   "must be 3 to 63 characters long",
+		strings.Repeat("x", 64) + "{{.Hash}}": "must be 3 to 63 characters long",
+	} {
+		if _, err := newShareNamer(tmpl); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: got error %v, want %q", tmpl, err, want)
+		}
+	}
+}
+
+func TestCreateGeneratedShareCollisions(t *testing.T) {
+	// the first choice exists in the account, the second is used by
+	// another volume
+	svc := &fakeShareService{
+		quotas: map[string]int{"docker-myvol-d63aeb72": maxShareQuota},
+		set:    map[string]int{},
+	}
+	d, cleanup := testVolumeDriver(t, svc)
+	defer cleanup()
+	if err := d.meta.Set("other", volumeMetadata{Options: VolumeOptions{Share: "docker-myvol-999fbf9e"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := d.Create(volume.Request{Name: "myvol"}); resp.Err != "" {
+		t.Fatal(resp.Err)
+	}
+	meta, err := d.meta.Get(log.NewEntry(log.StandardLogger()), "myvol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "docker-myvol-b2bd85f4"; meta.Options.Share != want {
+		t.Errorf("got share %q, want %q", meta.Options.Share, want)
+	}
+
+	// all attempts taken
+	for i := 0; i < maxShareNameAttempts; i++ {
+		share, _ := d.namer.Name("taken", i)
+		svc.quotas[share] = maxShareQuota
+	}
+	if resp := d.Create(volume.Request{Name: "taken"}); !strings.Contains(resp.Err, "could not find an unused share name") {
+		t.Errorf("got error %q", resp.Err)
+	}
+}
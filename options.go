@@ -0,0 +1,370 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSMBVersion = "3.0"
+
+	removePolicyRetain   = "retain"
+	removePolicyDelete   = "delete"
+	removePolicySnapshot = "snapshot-then-delete"
+
+	// maxShareQuota is the largest quota in GiB of an Azure File share.
+	maxShareQuota = 5120
+)
+
+var (
+	// allowedSMBVersions are the SMB dialects Azure File Service speaks.
+	allowedSMBVersions = []string{"2.1", "3.0", "3.1.1"}
+
+	// allowedCacheModes are the values mount.cifs accepts for 'cache'.
+	allowedCacheModes = []string{"strict", "loose", "none"}
+
+	allowedRemovePolicies = []string{removePolicyRetain, removePolicyDelete, removePolicySnapshot}
+
+	// shareNameRe matches valid Azure File share names: lowercase letters,
+	// numbers and single hyphens, starting and ending with a letter or number.
+	// Length is checked separately.
+	//
+	// See https://msdn.microsoft.com/en-us/library/azure/dn167011.aspx
+	shareNameRe = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+)
+
+// optionErrors collects per-option validation failures so that all problems
+// with a volume create request are reported at once.
+type optionErrors []string
+
+func (e optionErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+func (e *optionErrors) add(name string, err error) {
+	*e = append(*e, fmt.Sprintf("invalid value for '%s': %v", name, err))
+}
+
+// parseVolumeOptions parses and validates the driver options passed by the
+// docker engine. Every value is checked against its expected type or an
+// allow-list, so that nothing from the volume options ends up in the mount
+// option string verbatim.
+func parseVolumeOptions(meta map[string]string) (VolumeOptions, error) {
+	var (
+		opts VolumeOptions
+		errs optionErrors
+		err  error
+	)
+
+	if v, ok := meta["share"]; ok {
+		if err = validateShareName(v); err != nil {
+			errs.add("share", err)
+		} else {
+			opts.Share = v
+		}
+	}
+	if v, ok := meta["filemode"]; ok {
+		if opts.FileMode, err = parseMode(v); err != nil {
+			errs.add("filemode", err)
+		}
+	}
+	if v, ok := meta["dirmode"]; ok {
+		if opts.DirMode, err = parseMode(v); err != nil {
+			errs.add("dirmode", err)
+		}
+	}
+	if v, ok := meta["uid"]; ok {
+		if opts.UID, err = parseID(v, lookupUID); err != nil {
+			errs.add("uid", err)
+		}
+	}
+	if v, ok := meta["gid"]; ok {
+		if opts.GID, err = parseID(v, lookupGID); err != nil {
+			errs.add("gid", err)
+		}
+	}
+	if v, ok := meta["remotepath"]; ok {
+		if opts.RemotePath, err = parseRemotePath(v); err != nil {
+			errs.add("remotepath", err)
+		}
+	}
+	if v, ok := meta["vers"]; ok {
+		if oneOf(v, allowedSMBVersions) {
+			opts.Vers = v
+		} else {
+			errs.add("vers", fmt.Errorf("%q is not one of %v", v, allowedSMBVersions))
+		}
+	}
+	if v, ok := meta["cache"]; ok {
+		if oneOf(v, allowedCacheModes) {
+			opts.Cache = v
+		} else {
+			errs.add("cache", fmt.Errorf("%q is not one of %v", v, allowedCacheModes))
+		}
+	}
+	if v, ok := meta["removepolicy"]; ok {
+		if oneOf(v, allowedRemovePolicies) {
+			opts.RemovePolicy = v
+		} else {
+			errs.add("removepolicy", fmt.Errorf("%q is not one of %v", v, allowedRemovePolicies))
+		}
+	}
+	if v, ok := meta["actimeo"]; ok {
+		if n, err := strconv.ParseUint(v, 10, 32); err != nil {
+			errs.add("actimeo", fmt.Errorf("%q is not a non-negative number of seconds", v))
+		} else {
+			opts.ActimeO = strconv.FormatUint(n, 10)
+		}
+	}
+	if v, ok := meta["quota"]; ok {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxShareQuota {
+			errs.add("quota", fmt.Errorf("%q is not a share size between 1 and %d GiB", v, maxShareQuota))
+		}
+		opts.Quota = n
+	}
+	if v, ok := meta["serverino"]; ok {
+		b, err := parseBool(v)
+		if err != nil {
+			errs.add("serverino", err)
+		}
+		opts.ServerIno = &b
+	}
+
+	flags := []struct {
+		name string
+		dst  *bool
+	}{
+		{"nolock", &opts.NoLock},
+		{"mfsymlinks", &opts.MFSymlinks},
+		{"nobrl", &opts.NoBRL},
+		{"seal", &opts.Seal},
+		{"ro", &opts.ReadOnly},
+		{"subdir", &opts.Subdir},
+	}
+	for _, f := range flags {
+		v, ok := meta[f.name]
+		if !ok {
+			continue
+		}
+		if *f.dst, err = parseBool(v); err != nil {
+			errs.add(f.name, err)
+		}
+	}
+
+	if opts.Seal && opts.Vers == "2.1" {
+		errs = append(errs, "option 'seal' requires 'vers' 3.0 or higher")
+	}
+	if opts.Quota > 0 && opts.Subdir {
+		errs = append(errs, "option 'quota' cannot be used with 'subdir', the share is shared with other volumes")
+	}
+	if len(errs) > 0 {
+		return opts, errs
+	}
+	return opts, nil
+}
+
+// validateShareName checks the Azure File Service naming rules for shares.
+func validateShareName(name string) error {
+	if len(name) < 3 || len(name) > 63 {
+		return fmt.Errorf("%q must be 3 to 63 characters long", name)
+	}
+	if !shareNameRe.MatchString(name) {
+		return fmt.Errorf("%q must consist of lowercase letters, numbers and single hyphens, and start and end with a letter or number", name)
+	}
+	return nil
+}
+
+// parseMode parses an octal permission mode such as 0755 and returns it in
+// the canonical 4-digit form mount.cifs expects.
+func parseMode(s string) (string, error) {
+	n, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || n > 07777 {
+		return "", fmt.Errorf("%q is not an octal file mode (e.g. 0755)", s)
+	}
+	return fmt.Sprintf("%04o", n), nil
+}
+
+// parseID parses a numeric user or group ID, or resolves a name to its
+// numeric ID on this host using lookup.
+func parseID(s string, lookup func(string) (string, error)) (string, error) {
+	if n, err := strconv.ParseUint(s, 10, 32); err == nil {
+		return strconv.FormatUint(n, 10), nil
+	}
+	id, err := lookup(s)
+	if err != nil {
+		return "", fmt.Errorf("%q is neither numeric nor resolvable: %v", s, err)
+	}
+	return id, nil
+}
+
+func lookupUID(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGID(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// parseBool accepts the standard boolean forms (1, t, true, yes, on, and
+// their negatives).
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes", "on":
+		return true, nil
+	case "no", "off":
+		return false, nil
+	}
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		return false, fmt.Errorf("%q is not a boolean (use true or false)", s)
+	}
+	return b, nil
+}
+
+// parseRemotePath validates a path inside the share and returns it without
+// leading or trailing slashes.
+func parseRemotePath(s string) (string, error) {
+	p := strings.Trim(s, "/")
+	if p == "" {
+		return "", fmt.Errorf("%q does not name a directory", s)
+	}
+	if strings.ContainsAny(p, "\\,\"*:<>?|") {
+		return "", fmt.Errorf("%q contains characters not allowed in Azure File paths", s)
+	}
+	for _, r := range p {
+		if r < 0x20 || r == 0x7f {
+			return "", fmt.Errorf("%q contains control characters", s)
+		}
+	}
+	for _, c := range strings.Split(p, "/") {
+		if c == "" || c == "." || c == ".." {
+			return "", fmt.Errorf("%q must not contain empty, '.' or '..' path components", s)
+		}
+	}
+	return p, nil
+}
+
+// storedValueRe matches the option values that are safe to pass to mount.cifs
+// as they are.
+var storedValueRe = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+
+// checkStoredOptions rejects the stored options of a volume that cannot be
+// mounted safely. Every value cifsMountOptions puts into the mount option
+// string is checked against the allow-list parseVolumeOptions uses, since
+// records written before options were validated, or imported from a bundle,
+// may hold values that were never checked.
+func checkStoredOptions(options VolumeOptions) error {
+	invalid := func(name string, err error) error {
+		return fmt.Errorf("stored volume option '%s' is invalid, recreate the volume: %v", name, err)
+	}
+	for _, o := range []struct{ name, value string }{
+		{"filemode", options.FileMode},
+		{"dirmode", options.DirMode},
+	} {
+		if o.value == "" {
+			continue
+		}
+		if _, err := parseMode(o.value); err != nil {
+			return invalid(o.name, err)
+		}
+	}
+	for _, o := range []struct{ name, value string }{
+		{"uid", options.UID},
+		{"gid", options.GID},
+	} {
+		if !storedValueRe.MatchString(o.value) {
+			return invalid(o.name, fmt.Errorf("%q is not a user or group", o.value))
+		}
+	}
+	if v := options.Vers; v != "" && !oneOf(v, allowedSMBVersions) {
+		return invalid("vers", fmt.Errorf("%q is not one of %v", v, allowedSMBVersions))
+	}
+	if v := options.Cache; v != "" && !oneOf(v, allowedCacheModes) {
+		return invalid("cache", fmt.Errorf("%q is not one of %v", v, allowedCacheModes))
+	}
+	if v := options.ActimeO; v != "" {
+		if _, err := strconv.ParseUint(v, 10, 32); err != nil {
+			return invalid("actimeo", fmt.Errorf("%q is not a non-negative number of seconds", v))
+		}
+	}
+	return nil
+}
+
+// cifsMountOptions returns the mount.cifs option list for the volume options,
+// excluding credentials.
+func cifsMountOptions(options VolumeOptions) []string {
+	// Set defaults
+	if len(options.FileMode) == 0 {
+		options.FileMode = "0777"
+	}
+	if len(options.DirMode) == 0 {
+		options.DirMode = "0777"
+	}
+	if len(options.UID) == 0 {
+		options.UID = "0"
+	}
+	if len(options.GID) == 0 {
+		options.GID = "0"
+	}
+	vers := options.Vers
+	if vers == "" {
+		vers = defaultSMBVersion
+	}
+	opts := []string{
+		fmt.Sprintf("vers=%s", vers),
+		fmt.Sprintf("file_mode=%s", options.FileMode),
+		fmt.Sprintf("dir_mode=%s", options.DirMode),
+		fmt.Sprintf("uid=%s", options.UID),
+		fmt.Sprintf("gid=%s", options.GID),
+	}
+	if options.NoLock {
+		opts = append(opts, "nolock")
+	}
+	if options.Cache != "" {
+		opts = append(opts, fmt.Sprintf("cache=%s", options.Cache))
+	}
+	if options.ActimeO != "" {
+		opts = append(opts, fmt.Sprintf("actimeo=%s", options.ActimeO))
+	}
+	if options.ServerIno != nil {
+		if *options.ServerIno {
+			opts = append(opts, "serverino")
+		} else {
+			opts = append(opts, "noserverino")
+		}
+	}
+	if options.MFSymlinks {
+		opts = append(opts, "mfsymlinks")
+	}
+	if options.NoBRL {
+		opts = append(opts, "nobrl")
+	}
+	if options.Seal {
+		opts = append(opts, "seal")
+	}
+	if options.ReadOnly {
+		opts = append(opts, "ro")
+	}
+	return opts
+}
+
+func oneOf(s string, list []string) bool {
+	for _, v := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
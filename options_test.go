@@ -0,0 +1,159 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCifsMountOptions(t *testing.T) {
+	opts, err := parseVolumeOptions(map[string]string{
+		"share":      "myshare",
+		"filemode":   "644",
+		"dirmode":    "0755",
+		"uid":        "1000",
+		"gid":        "1000",
+		"nolock":     "true",
+		"vers":       "3.1.1",
+		"cache":      "none",
+		"actimeo":    "30",
+		"serverino":  "false",
+		"mfsymlinks": "yes",
+		"ro":         "1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"vers=3.1.1", "file_mode=0644", "dir_mode=0755", "uid=1000", "gid=1000", "nolock",
+		"cache=none", "actimeo=30", "noserverino", "mfsymlinks", "ro"}
+	if got := cifsMountOptions(opts); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	want = []string{"vers=3.0", "file_mode=0777", "dir_mode=0777", "uid=0", "gid=0"}
+	if got := cifsMountOptions(VolumeOptions{}); !reflect.DeepEqual(got, want) {
+		t.Errorf("defaults: got %v, want %v", got, want)
+	}
+}
+
+// TestCifsMountOptionsInjection checks that no volume option value can add
+// options of its own to the mount option string.
+func TestCifsMountOptionsInjection(t *testing.T) {
+	hostile := []string{
+		"0,cred=/etc/x",
+		"0=1",
+		",",
+		"=",
+		"0777,uid=0",
+		"1000,sec=none",
+		"3.0,password=x",
+		"strict,cred=/etc/x",
+		"1 ,nolock",
+		"true,guest",
+		"0777\x00,uid=0",
+	}
+	names := []string{"filemode", "dirmode", "uid", "gid", "vers", "cache", "actimeo",
+		"serverino", "nolock", "mfsymlinks", "nobrl", "seal", "ro"}
+	for _, name := range names {
+		for _, v := range hostile {
+			opts, err := parseVolumeOptions(map[string]string{name: v})
+			if err == nil {
+				t.Errorf("%s=%q: accepted", name, v)
+			}
+			for _, o := range cifsMountOptions(opts) {
+				if strings.Contains(o, ",") || strings.Count(o, "=") > 1 {
+					t.Errorf("%s=%q: mount option %q contains user input", name, v, o)
+				}
+			}
+		}
+	}
+}
+
+func TestParseVolumeOptions(t *testing.T) {
+	yes, no := true, false
+	cases := []struct {
+		opts map[string]string
+		want VolumeOptions
+		errs []string // substrings of the expected error, nil for success
+	}{
+		{opts: map[string]string{}},
+
+		// octal modes
+		{opts: map[string]string{"filemode": "644", "dirmode": "0755"}, want: VolumeOptions{FileMode: "0644", DirMode: "0755"}},
+		{opts: map[string]string{"filemode": "7777"}, want: VolumeOptions{FileMode: "7777"}},
+		{opts: map[string]string{"filemode": "0888"}, errs: []string{"invalid value for 'filemode': \"0888\" is not an octal file mode"}},
+		{opts: map[string]string{"dirmode": "17777"}, errs: []string{"invalid value for 'dirmode'"}},
+		{opts: map[string]string{"dirmode": "rwx"}, errs: []string{"invalid value for 'dirmode'"}},
+		{opts: map[string]string{"filemode": "-1"}, errs: []string{"invalid value for 'filemode'"}},
+
+		// numeric and named IDs
+		{opts: map[string]string{"uid": "1000", "gid": "01000"}, want: VolumeOptions{UID: "1000", GID: "1000"}},
+		{opts: map[string]string{"uid": "root", "gid": "root"}, want: VolumeOptions{UID: "0", GID: "0"}},
+		{opts: map[string]string{"uid": "no-such-user-x"}, errs: []string{"invalid value for 'uid': \"no-such-user-x\" is neither numeric nor resolvable"}},
+		{opts: map[string]string{"gid": "no-such-group-x"}, errs: []string{"invalid value for 'gid'"}},
+		{opts: map[string]string{"uid": "4294967296"}, errs: []string{"invalid value for 'uid'"}},
+
+		// boolean forms
+		{opts: map[string]string{"nolock": "yes", "nobrl": "on", "ro": "1", "mfsymlinks": "TRUE"},
+			want: VolumeOptions{NoLock: true, NoBRL: true, ReadOnly: true, MFSymlinks: true}},
+		{opts: map[string]string{"serverino": "off"}, want: VolumeOptions{ServerIno: &no}},
+		{opts: map[string]string{"serverino": "t"}, want: VolumeOptions{ServerIno: &yes}},
+		{opts: map[string]string{"nolock": "maybe"}, errs: []string{"invalid value for 'nolock': \"maybe\" is not a boolean"}},
+		{opts: map[string]string{"ro": ""}, errs: []string{"invalid value for 'ro'"}},
+
+		// share names
+		{opts: map[string]string{"share": "my-share-1"}, want: VolumeOptions{Share: "my-share-1"}},
+		{opts: map[string]string{"share": "ab"}, errs: []string{"invalid value for 'share': \"ab\" must be 3 to 63 characters long"}},
+		{opts: map[string]string{"share": strings.Repeat("a", 64)}, errs: []string{"must be 3 to 63 characters long"}},
+		{opts: map[string]string{"share": "MyShare"}, errs: []string{"lowercase letters, numbers and single hyphens"}},
+		{opts: map[string]string{"share": "my--share"}, errs: []string{"single hyphens"}},
+		{opts: map[string]string{"share": "-myshare"}, errs: []string{"start and end with a letter or number"}},
+
+		// remote paths
+		{opts: map[string]string{"remotepath": "/a/b/"}, want: VolumeOptions{RemotePath: "a/b"}},
+		{opts: map[string]string{"remotepath": "a/../b"}, errs: []string{"invalid value for 'remotepath': \"a/../b\" must not contain empty, '.' or '..' path components"}},
+		{opts: map[string]string{"remotepath": ".."}, errs: []string{"'..' path components"}},
+		{opts: map[string]string{"remotepath": "a//b"}, errs: []string{"empty, '.' or '..'"}},
+		{opts: map[string]string{"remotepath": "/"}, errs: []string{"does not name a directory"}},
+		{opts: map[string]string{"remotepath": "a,b"}, errs: []string{"characters not allowed"}},
+		{opts: map[string]string{"remotepath": "a\nb"}, errs: []string{"control characters"}},
+
+		// enumerations and numbers
+		{opts: map[string]string{"vers": "2.1", "cache": "loose", "actimeo": "0", "removepolicy": "delete"},
+			want: VolumeOptions{Vers: "2.1", Cache: "loose", ActimeO: "0", RemovePolicy: "delete"}},
+		{opts: map[string]string{"vers": "1.0"}, errs: []string{"invalid value for 'vers': \"1.0\" is not one of [2.1 3.0 3.1.1]"}},
+		{opts: map[string]string{"actimeo": "-1"}, errs: []string{"invalid value for 'actimeo'"}},
+		{opts: map[string]string{"quota": "5121"}, errs: []string{"invalid value for 'quota'"}},
+
+		// combinations
+		{opts: map[string]string{"seal": "true", "vers": "2.1"}, errs: []string{"option 'seal' requires 'vers' 3.0 or higher"}},
+		{opts: map[string]string{"quota": "10", "subdir": "true"}, errs: []string{"option 'quota' cannot be used with 'subdir'"}},
+
+		// all problems are reported at once
+		{opts: map[string]string{"filemode": "x", "uid": "no-such-user-x", "share": "A", "remotepath": "..", "nolock": "maybe"},
+			errs: []string{"'filemode'", "'uid'", "'share'", "'remotepath'", "'nolock'"}},
+	}
+	for _, c := range cases {
+		got, err := parseVolumeOptions(c.opts)
+		if c.errs == nil {
+			if err != nil {
+				t.Errorf("%v: unexpected error: %v", c.opts, err)
+			} else if !reflect.DeepEqual(got, c.want) {
+				t.Errorf("%v: got %+v, want %+v", c.opts, got, c.want)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%v: expected error", c.opts)
+			continue
+		}
+		for _, s := range c.errs {
+			if !strings.Contains(err.Error(), s) {
+				t.Errorf("%v: error %q does not contain %q", c.opts, err, s)
+			}
+		}
+		if n := len(err.(optionErrors)); n != len(c.errs) && len(c.errs) > 1 {
+			t.Errorf("%v: got %d errors, want %d: %v", c.opts, n, len(c.errs), err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"sort"
+)
+
+// volumePolicy restricts the volumes users may create, so that having access
+// to the docker engine does not give access to every share in the account.
+// A nil policy allows everything.
+type volumePolicy struct {
+	// AllowedAccounts are the storage accounts volumes may be created on.
+	AllowedAccounts []string `json:"allowed_accounts,omitempty"`
+
+	// AllowedShares are glob patterns (as in path.Match) the share of a new
+	// volume must match, including generated share names.
+	AllowedShares []string `json:"allowed_shares,omitempty"`
+
+	// RequiredOptions must be passed when creating a volume. Labels can be
+	// required as label.<key>.
+	RequiredOptions []string `json:"required_options,omitempty"`
+
+	// ForbiddenOptions must not be passed when creating a volume.
+	ForbiddenOptions []string `json:"forbidden_options,omitempty"`
+
+	// MaxQuota is the largest share quota in GiB a volume may ask for, zero
+	// means no limit. When set, volumes that own their share must have the
+	// 'quota' option.
+	MaxQuota int `json:"max_quota,omitempty"`
+}
+
+// policyError is returned when a volume is denied by the policy. Rule is the
+// policy setting that denied it.
+type policyError struct {
+	Rule   string
+	Reason string
+}
+
+func (e policyError) Error() string {
+	return fmt.Sprintf("denied by policy rule '%s': %s", e.Rule, e.Reason)
+}
+
+// loadPolicy reads a policy file in JSON format.
+func loadPolicy(file string) (*volumePolicy, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read policy: %v", err)
+	}
+	var p volumePolicy
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("cannot parse policy %s: %v", file, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", file, err)
+	}
+	return &p, nil
+}
+
+func (p *volumePolicy) validate() error {
+	for _, pat := range p.AllowedShares {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("invalid share pattern %q in 'allowed_shares'", pat)
+		}
+	}
+	for _, o := range append(append([]string{}, p.RequiredOptions...), p.ForbiddenOptions...) {
+		if !oneOf(o, recognizedOptions) && !isLabelOption(o) {
+			return fmt.Errorf("unknown volume option %q, recognized options: %v", o, recognizedOptions)
+		}
+	}
+	for _, o := range p.RequiredOptions {
+		if oneOf(o, p.ForbiddenOptions) {
+			return fmt.Errorf("option %q is both required and forbidden", o)
+		}
+	}
+	if p.MaxQuota < 0 || p.MaxQuota > maxShareQuota {
+		return fmt.Errorf("'max_quota' must be between 1 and %d GiB, or 0 for no limit", maxShareQuota)
+	}
+	return nil
+}
+
+// checkVolume checks the storage account and the options of a volume create
+// request against the policy. rawOptions are the options as passed by the
+// docker engine and options their parsed form.
+func (p *volumePolicy) checkVolume(account string, rawOptions map[string]string, options VolumeOptions) error {
+	if p == nil {
+		return nil
+	}
+	if len(p.AllowedAccounts) > 0 && !oneOf(account, p.AllowedAccounts) {
+		return policyError{"allowed_accounts", fmt.Sprintf("storage account %q is not allowed", account)}
+	}
+	for _, o := range p.RequiredOptions {
+		if _, ok := rawOptions[o]; !ok {
+			return policyError{"required_options", fmt.Sprintf("option '%s' is required", o)}
+		}
+	}
+	var passed []string
+	for o := range rawOptions {
+		passed = append(passed, o)
+	}
+	sort.Strings(passed)
+	for _, o := range passed {
+		if oneOf(o, p.ForbiddenOptions) {
+			return policyError{"forbidden_options", fmt.Sprintf("option '%s' is not allowed", o)}
+		}
+	}
+	if p.MaxQuota > 0 {
+		// subdirectory volumes cannot set the quota of their share
+		if options.Quota == 0 && !options.Subdir {
+			return policyError{"max_quota", fmt.Sprintf("option 'quota' is required (at most %d GiB)", p.MaxQuota)}
+		}
+		if options.Quota > p.MaxQuota {
+			return policyError{"max_quota", fmt.Sprintf("quota of %d GiB exceeds the maximum of %d GiB", options.Quota, p.MaxQuota)}
+		}
+	}
+	return nil
+}
+
+// checkShare checks the share a volume is created on against the policy.
+func (p *volumePolicy) checkShare(share string) error {
+	if p == nil || len(p.AllowedShares) == 0 {
+		return nil
+	}
+	for _, pat := range p.AllowedShares {
+		if ok, _ := path.Match(pat, share); ok {
+			return nil
+		}
+	}
+	return policyError{"allowed_shares", fmt.Sprintf("share %q does not match any of %v", share, p.AllowedShares)}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPolicyValidateMaxQuota(t *testing.T) {
+	for _, n := range []int{0, 1, 100, maxShareQuota} {
+		p := volumePolicy{MaxQuota: n}
+		if err := p.validate(); err != nil {
+			t.Errorf("max_quota %d: %v", n, err)
+		}
+	}
+	for _, n := range []int{-1, maxShareQuota + 1} {
+		p := volumePolicy{MaxQuota: n}
+		if err := p.validate(); err == nil || !strings.Contains(err.Error(), "or 0 for no limit") {
+			t.Errorf("max_quota %d: got error %v", n, err)
+		}
+	}
+
+	// zero does not require the quota option
+	p := volumePolicy{}
+	if err := p.checkVolume("acct", map[string]string{}, VolumeOptions{}); err != nil {
+		t.Errorf("no limit: %v", err)
+	}
+	p.MaxQuota = 100
+	if err := p.checkVolume("acct", map[string]string{}, VolumeOptions{}); err == nil {
+		t.Error("limit without quota option: accepted")
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultRestoreParallelism = 4
+	restoreProgressInterval   = 5 * time.Second
+)
+
+// uploader copies files into a directory of a share with the File REST API.
+// Directory and file creation and Put Range calls run in the background, at
+// most a fixed number of them at a time.
+type uploader struct {
+	files *fileAPI
+	share string
+	root  string
+
+	sem chan struct{} // bounds the number of calls in flight
+	wg  sync.WaitGroup
+
+	mu    sync.Mutex
+	dirs  map[string]*uploadDir
+	err   error
+	stats backupStats
+}
+
+// uploadDir is a directory created, once, by the first upload needing it.
+type uploadDir struct {
+	once sync.Once
+	err  error
+}
+
+// uploadFile tracks a file whose ranges are being uploaded.
+type uploadFile struct {
+	remote  string
+	created chan struct{} // closed once the file is created, or failed to
+	err     error         // creation error, set before created is closed
+	pending int           // ranges not written yet, guarded by uploader.mu
+}
+
+func newUploader(files *fileAPI, share, root string, parallelism int) *uploader {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	return &uploader{
+		files: files,
+		share: share,
+		root:  root,
+		sem:   make(chan struct{}, parallelism),
+		dirs:  make(map[string]*uploadDir),
+	}
+}
+
+// restoreArchive uploads the contents of a tar archive, optionally gzip
+// compressed, into the directory.
+func (u *uploader) restoreArchive(r io.Reader) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("cannot read gzip archive: %v", err)
+		}
+		defer gz.Close()
+		r = gz
+	} else {
+		r = br
+	}
+
+	if err := u.queueArchive(tar.NewReader(r)); err != nil {
+		u.wait()
+		return err
+	}
+	return u.wait()
+}
+
+func (u *uploader) queueArchive(tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("cannot read archive: %v", err)
+		}
+		name, err := archivePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			u.run(func() error { return u.mkdirAll(name) })
+		case tar.TypeReg, tar.TypeRegA:
+			err = u.upload(name, hdr.Size, tr)
+		default:
+			log.Warnf("skipping %q: unsupported file type in archive", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// restoreDirectory uploads the contents of a local directory tree into the
+// directory.
+func (u *uploader) restoreDirectory(dir string) error {
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		switch {
+		case info.IsDir():
+			u.run(func() error { return u.mkdirAll(name) })
+			return nil
+		case info.Mode().IsRegular():
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			return u.upload(name, info.Size(), f)
+		default:
+			log.Warnf("skipping %q: not a regular file or directory", p)
+			return nil
+		}
+	})
+	if err != nil {
+		u.wait()
+		return err
+	}
+	return u.wait()
+}
+
+// upload queues the creation of the file and the upload of its content in
+// ranges. It reads r synchronously, so r can be reused once upload returns;
+// at most one range more than the calls in flight is held in memory.
+func (u *uploader) upload(name string, size int64, r io.Reader) error {
+	if err := u.firstError(); err != nil {
+		return err
+	}
+	f := &uploadFile{
+		remote:  path.Join(u.root, name),
+		created: make(chan struct{}),
+		pending: int((size + maxRangeSize - 1) / maxRangeSize),
+	}
+	u.run(func() error {
+		defer close(f.created)
+		if f.err = u.mkdirAll(path.Dir(name)); f.err != nil {
+			return f.err
+		}
+		if err := u.files.CreateFile(u.share, f.remote, size); err != nil {
+			f.err = fmt.Errorf("cannot create %q: %v", f.remote, err)
+			return f.err
+		}
+		if size == 0 {
+			u.fileDone(f, 0)
+		}
+		return nil
+	})
+
+	for offset := int64(0); offset < size; {
+		n := size - offset
+		if n > maxRangeSize {
+			n = maxRangeSize
+		}
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return fmt.Errorf("cannot read %q: %v", name, err)
+		}
+		u.putRange(f, offset, buf)
+		offset += n
+	}
+	return nil
+}
+
+// putRange queues writing buf at offset once the file is created.
+func (u *uploader) putRange(f *uploadFile, offset int64, buf []byte) {
+	u.run(func() error {
+		<-f.created
+		if f.err != nil {
+			return nil // reported by the creation
+		}
+		if !isZero(buf) { // new files read as zeros already
+			if err := u.files.PutRange(u.share, f.remote, offset, buf); err != nil {
+				return fmt.Errorf("cannot write %q at offset %d: %v", f.remote, offset, err)
+			}
+		}
+		u.fileDone(f, int64(len(buf)))
+		return nil
+	})
+}
+
+// fileDone records n bytes of the file as uploaded, and the file itself once
+// its last range is written.
+func (u *uploader) fileDone(f *uploadFile, n int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.stats.Bytes += n
+	if f.pending--; f.pending <= 0 {
+		u.stats.Files++
+	}
+}
+
+// run runs job in the background once fewer calls than the parallelism are
+// in flight. The first error is kept and returned by wait.
+func (u *uploader) run(job func() error) {
+	u.sem <- struct{}{}
+	u.wg.Add(1)
+	go func() {
+		defer func() {
+			<-u.sem
+			u.wg.Done()
+		}()
+		if err := job(); err != nil {
+			u.setError(err)
+		}
+	}()
+}
+
+// mkdirAll creates the directory and its parents, unless an earlier call
+// did. Concurrent calls for the same directory wait for the first one.
+func (u *uploader) mkdirAll(name string) error {
+	if name == "." || name == "" {
+		return nil
+	}
+	u.mu.Lock()
+	d := u.dirs[name]
+	if d == nil {
+		d = &uploadDir{}
+		u.dirs[name] = d
+	}
+	u.mu.Unlock()
+
+	d.once.Do(func() {
+		if d.err = u.mkdirAll(path.Dir(name)); d.err != nil {
+			return
+		}
+		remote := path.Join(u.root, name)
+		if _, err := u.files.CreateDirectory(u.share, remote); err != nil {
+			d.err = fmt.Errorf("cannot create directory %q: %v", remote, err)
+		}
+	})
+	return d.err
+}
+
+// wait waits for the queued calls and returns the first upload error.
+func (u *uploader) wait() error {
+	u.wg.Wait()
+	return u.firstError()
+}
+
+func (u *uploader) setError(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.err == nil {
+		u.err = err
+	}
+}
+
+func (u *uploader) firstError() error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.err
+}
+
+// progress returns the files and bytes uploaded so far.
+func (u *uploader) progress() backupStats {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.stats
+}
+
+// reportProgress logs the progress of the upload every interval until stop
+// is closed.
+func (u *uploader) reportProgress(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p := u.progress()
+			log.Infof("uploaded %d file(s), %d byte(s) so far", p.Files, p.Bytes)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// archivePath cleans the name of an archive entry and rejects names that
+// would escape the target directory.
+func archivePath(name string) (string, error) {
+	for _, c := range strings.Split(name, "/") {
+		if c == ".." {
+			return "", fmt.Errorf("invalid path in archive: %q", name)
+		}
+	}
+	return strings.Trim(path.Clean("/"+name), "/"), nil
+}
+
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
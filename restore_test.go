@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeFileService accepts directory, file and range creation, tracking the
+// largest number of requests served at the same time.
+type fakeFileService struct {
+	mu          sync.Mutex
+	inFlight    int
+	maxInFlight int
+	dirs, files map[string]bool
+	ranges      int
+}
+
+func (s *fakeFileService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inFlight--
+	q := r.URL.Query()
+	switch {
+	case q.Get("restype") == "directory":
+		s.dirs[r.URL.Path] = true
+	case q.Get("comp") == "range":
+		s.ranges++
+	default:
+		s.files[r.URL.Path] = true
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+func TestRestoreDirectoryParallel(t *testing.T) {
+	src, err := ioutil.TempDir("", "azurefile-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	const n = 20
+	for i := 0; i < n; i++ {
+		dir := filepath.Join(src, fmt.Sprintf("d%d", i%3), "sub")
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d", i)), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "empty"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &fakeFileService{dirs: map[string]bool{}, files: map[string]bool{}}
+	srv := httptest.NewServer(fs)
+	defer srv.Close()
+
+	u := newUploader(testFileAPI(t, srv.URL+"/devstoreaccount1"), "myshare", "vol", 4)
+	if err := u.restoreDirectory(src); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs.maxInFlight < 2 || fs.maxInFlight > 4 {
+		t.Errorf("got %d requests in flight at most, want 2 to 4", fs.maxInFlight)
+	}
+	if len(fs.files) != n+1 || fs.ranges != n {
+		t.Errorf("got %d files and %d ranges, want %d and %d", len(fs.files), fs.ranges, n+1, n)
+	}
+	if !fs.dirs["/devstoreaccount1/myshare/vol/d0/sub"] || len(fs.dirs) != 6 {
+		t.Errorf("unexpected directories %v", fs.dirs)
+	}
+	if p := u.progress(); p.Files != n+1 || p.Bytes != 4*n {
+		t.Errorf("got %d files, %d bytes uploaded, want %d, %d", p.Files, p.Bytes, n+1, 4*n)
+	}
+}
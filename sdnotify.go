@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// sdNotify sends a state notification such as "READY=1" to the service
+// manager. Returns false if the process is not run by a service manager that
+// expects notifications (NOTIFY_SOCKET is not set).
+//
+// See sd_notify(3).
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	addr := &net.UnixAddr{Name: socket, Net: "unixgram"}
+	if socket[0] == '@' {
+		addr.Name = "\x00" + socket[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, addr)
+	if err != nil {
+		return false, fmt.Errorf("cannot connect to notify socket: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("cannot send notification: %v", err)
+	}
+	return true, nil
+}
+
+// watchdogInterval returns the interval the service manager expects
+// "WATCHDOG=1" notifications within, or zero if the watchdog is not enabled
+// for this process.
+//
+// See sd_watchdog_enabled(3).
+func watchdogInterval() (time.Duration, error) {
+	s := os.Getenv("WATCHDOG_USEC")
+	if s == "" {
+		return 0, nil
+	}
+	usec, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", s)
+	}
+	if p := os.Getenv("WATCHDOG_PID"); p != "" {
+		pid, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, fmt.Errorf("invalid WATCHDOG_PID %q", p)
+		}
+		if pid != os.Getpid() {
+			return 0, nil
+		}
+	}
+	return time.Duration(usec) * time.Microsecond, nil
+}
+
+// startWatchdog sends "WATCHDOG=1" notifications at half the watchdog
+// interval for as long as check succeeds, until stop is closed. It does
+// nothing if the watchdog is not enabled.
+func startWatchdog(check func() error, stop <-chan struct{}) error {
+	interval, err := watchdogInterval()
+	if err != nil || interval == 0 {
+		return err
+	}
+	log.Debugf("notifying systemd watchdog every %v", interval/2)
+	go func() {
+		t := time.NewTicker(interval / 2)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if err := check(); err != nil {
+					log.Errorf("health check failed, not notifying watchdog: %v", err)
+					continue
+				}
+				if _, err := sdNotify("WATCHDOG=1"); err != nil {
+					log.Warn(err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
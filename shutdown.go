@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+const defaultShutdownTimeout = 30 * time.Second
+
+// maxUnmountAttempts bounds the unmount attempts per volume on exit, as the
+// same volume may be mounted several times on its mountpoint.
+const maxUnmountAttempts = 10
+
+// shutdownConfig configures what happens when the driver is stopped.
+type shutdownConfig struct {
+	// Timeout limits how long to wait for the operation in progress.
+	Timeout time.Duration
+
+	// UnmountAll unmounts all volumes on exit. Otherwise mounts are left in
+	// place for the containers still using them.
+	UnmountAll bool
+}
+
+// serve serves the plugin API on l until serving fails or the process
+// receives SIGTERM or SIGINT. On a signal it stops accepting requests, shuts
+// the driver down and returns nil. A second signal exits immediately.
+//
+// When run by systemd, serve notifies it that the driver is ready and keeps
+// the service watchdog, if enabled, informed about the driver's health.
+func serve(h *volume.Handler, l net.Listener, d *volumeDriver, cfg shutdownConfig) error {
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(sigs)
+
+	errc := make(chan error, 1)
+	go func() { errc <- h.Serve(l) }()
+
+	if _, err := sdNotify("READY=1"); err != nil {
+		log.Warn(err)
+	}
+	stopWatchdog := make(chan struct{})
+	defer close(stopWatchdog)
+	if err := startWatchdog(d.checkHealth, stopWatchdog); err != nil {
+		log.Warnf("cannot enable watchdog: %v", err)
+	}
+
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-sigs:
+		log.Infof("received %v, shutting down", sig)
+	}
+	if _, err := sdNotify("STOPPING=1"); err != nil {
+		log.Warn(err)
+	}
+	go func() {
+		sig := <-sigs
+		log.Fatalf("received %v during shutdown, exiting immediately", sig)
+	}()
+
+	// Closing the listener stops accepting connections, and removes the
+	// socket file of unix sockets the driver created.
+	l.Close()
+	d.shutdown(cfg)
+	return nil
+}
+
+// shutdown waits for the operation in progress, if any, to finish and keeps
+// any further operation from starting. Volume operations are serialized by
+// the driver lock, which is never released again. Metadata is written
+// synchronously, so there is nothing left to flush afterwards.
+func (v *volumeDriver) shutdown(cfg shutdownConfig) {
+	locked := make(chan struct{})
+	go func() {
+		v.m.Lock()
+		close(locked)
+	}()
+
+	var timeout <-chan time.Time
+	if cfg.Timeout > 0 {
+		timeout = time.After(cfg.Timeout)
+	}
+	select {
+	case <-locked:
+		log.Debug("no volume operation in progress")
+	case <-timeout:
+		log.Warnf("volume operation still in progress after %v, exiting anyway", cfg.Timeout)
+		return
+	}
+
+	if cfg.UnmountAll {
+		if err := v.unmountAll(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
+// unmountAll unmounts every volume mounted by the driver and removes the
+// mountpoints. The driver lock must be held.
+func (v *volumeDriver) unmountAll() error {
+	vols, err := v.meta.List(log.WithField("operation", "shutdown"))
+	if err != nil {
+		return fmt.Errorf("cannot list volumes to unmount: %v", err)
+	}
+	var failed []string
+	for _, name := range vols {
+		logctx := log.WithFields(log.Fields{
+			"operation": "shutdown",
+			"name":      name,
+		})
+		path, err := v.pathForVolume(name)
+		if err != nil {
+			logctx.Error(err)
+			failed = append(failed, name)
+			continue
+		}
+		unmounted := false
+		for i := 0; i < maxUnmountAttempts; i++ {
+			mounted, err := isMounted(logctx, path)
+			if err != nil {
+				logctx.Error(err)
+				break
+			}
+			if !mounted {
+				unmounted = true
+				break
+			}
+			if err := unmount(path); err != nil {
+				logctx.Error(err)
+				break
+			}
+			logctx.Info("unmounted volume")
+		}
+		if !unmounted {
+			failed = append(failed, name)
+			continue
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logctx.Warnf("cannot remove mountpoint: %v", err)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("volumes left mounted: %v", failed)
+	}
+	return nil
+}
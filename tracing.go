@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// traceBatchSize and traceFlushInterval bound how many spans are kept
+	// and for how long before they are exported.
+	traceBatchSize     = 100
+	traceFlushInterval = 5 * time.Second
+
+	// traceQueueSize is the number of finished spans waiting for export
+	// beyond which new spans are dropped rather than slowing requests down.
+	traceQueueSize = 1000
+
+	traceServiceName = "azurefile-dockervolumedriver"
+)
+
+// defaultTracer receives the finished spans of the process. Tracing is
+// disabled while it is nil.
+var defaultTracer *tracer
+
+// span is a timed operation, such as a plugin request or an Azure API call,
+// in the style of OpenTelemetry spans. A nil span is valid and records
+// nothing, which is what startSpan returns when tracing is disabled.
+type span struct {
+	TraceID    string            `json:"traceId"`
+	SpanID     string            `json:"spanId"`
+	ParentID   string            `json:"parentSpanId,omitempty"`
+	Name       string            `json:"name"`
+	StartTime  time.Time         `json:"startTime"`
+	EndTime    time.Time         `json:"endTime"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Error      string            `json:"error,omitempty"`
+
+	tracer *tracer
+
+	// mu guards the span until it is finished, as HTTP client trace hooks
+	// may set attributes from other goroutines.
+	mu       sync.Mutex
+	finished bool
+}
+
+// startSpan starts a span, as a child of parent if parent is not nil.
+func startSpan(parent *span, name string) *span {
+	t := defaultTracer
+	if t == nil {
+		return nil
+	}
+	s := &span{
+		SpanID:     randomHex(8),
+		Name:       name,
+		StartTime:  time.Now(),
+		Attributes: make(map[string]string),
+		tracer:     t,
+	}
+	if parent != nil {
+		s.TraceID = parent.TraceID
+		s.ParentID = parent.SpanID
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	return s
+}
+
+// SetAttribute records a key/value pair on the span.
+func (s *span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.finished {
+		s.Attributes[key] = fmt.Sprint(value)
+	}
+}
+
+// Finish ends the span, marking it failed if errMsg is not empty, and
+// queues it for export.
+func (s *span) Finish(errMsg string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.finished {
+		s.mu.Unlock()
+		return
+	}
+	s.finished = true
+	s.EndTime = time.Now()
+	s.Error = errMsg
+	s.mu.Unlock()
+	s.tracer.add(s)
+}
+
+// FinishErr is Finish for an error value.
+func (s *span) FinishErr(err error) {
+	if err != nil {
+		s.Finish(err.Error())
+	} else {
+		s.Finish("")
+	}
+}
+
+// setupTracing enables tracing with spans exported to file or to the OTLP
+// endpoint. Tracing stays disabled if neither is set.
+func setupTracing(file, otlpEndpoint string) error {
+	var (
+		e   spanExporter
+		err error
+	)
+	switch {
+	case file != "" && otlpEndpoint != "":
+		return fmt.Errorf("trace spans can be exported either to a file or to an OTLP endpoint, not both")
+	case file != "":
+		e, err = newFileExporter(file)
+	case otlpEndpoint != "":
+		e, err = newOTLPExporter(otlpEndpoint)
+	default:
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defaultTracer = newTracer(e)
+	return nil
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// spanExporter sends finished spans to their destination.
+type spanExporter interface {
+	export(spans []*span) error
+	io.Closer
+}
+
+// tracer collects finished spans and exports them in batches in the
+// background.
+type tracer struct {
+	exporter spanExporter
+	spans    chan *span
+	done     chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newTracer(e spanExporter) *tracer {
+	t := &tracer{
+		exporter: e,
+		spans:    make(chan *span, traceQueueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+func (t *tracer) add(s *span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.spans <- s:
+	default:
+		log.Debugf("trace queue full, dropping span %q", s.Name)
+	}
+}
+
+func (t *tracer) run() {
+	defer close(t.done)
+	tick := time.NewTicker(traceFlushInterval)
+	defer tick.Stop()
+
+	var batch []*span
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.exporter.export(batch); err != nil {
+			log.Warnf("cannot export %d trace span(s): %v", len(batch), err)
+		}
+		batch = nil
+	}
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				flush()
+				return
+			}
+			if batch = append(batch, s); len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-tick.C:
+			flush()
+		}
+	}
+}
+
+// Close exports the spans still queued. Spans finished afterwards are
+// dropped.
+func (t *tracer) Close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.spans)
+	}
+	t.mu.Unlock()
+	<-t.done
+	return t.exporter.Close()
+}
+
+// fileExporter appends spans to a file, one JSON object per line.
+type fileExporter struct {
+	f *os.File
+}
+
+func newFileExporter(path string) (*fileExporter, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open trace file: %v", err)
+	}
+	return &fileExporter{f}, nil
+}
+
+func (e *fileExporter) export(spans []*span) error {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, s := range spans {
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+	}
+	_, err := e.f.Write(b.Bytes())
+	return err
+}
+
+func (e *fileExporter) Close() error {
+	return e.f.Close()
+}
+
+// otlpExporter sends spans to an OpenTelemetry collector with OTLP over HTTP
+// in its JSON encoding.
+//
+// See https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type otlpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func newOTLPExporter(endpoint string) (*otlpExporter, error) {
+	if !strings.HasPrefix(endpoint, "http://") && !strings.HasPrefix(endpoint, "https://") {
+		return nil, fmt.Errorf("OTLP endpoint %q must be an http:// or https:// URL", endpoint)
+	}
+	return &otlpExporter{
+		url:    strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		client: &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+type otlpKeyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func otlpAttributes(m map[string]string) []otlpKeyValue {
+	var kvs []otlpKeyValue
+	for k, v := range m {
+		kv := otlpKeyValue{Key: k}
+		kv.Value.StringValue = v
+		kvs = append(kvs, kv)
+	}
+	return kvs
+}
+
+func (e *otlpExporter) export(spans []*span) error {
+	out := make([]otlpSpan, len(spans))
+	for i, s := range spans {
+		o := otlpSpan{
+			TraceID:           s.TraceID,
+			SpanID:            s.SpanID,
+			ParentSpanID:      s.ParentID,
+			Name:              s.Name,
+			Kind:              1, // internal
+			StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			Attributes:        otlpAttributes(s.Attributes),
+		}
+		if s.Error != "" {
+			o.Status.Code = 2 // error
+			o.Status.Message = s.Error
+		}
+		out[i] = o
+	}
+	resource := map[string]string{"service.name": traceServiceName}
+	if GitSummary != "" {
+		resource["service.version"] = GitSummary
+	}
+	req := map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{"attributes": otlpAttributes(resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": traceServiceName},
+				"spans": out,
+			}},
+		}},
+	}
+	b, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *otlpExporter) Close() error {
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNilSpan(t *testing.T) {
+	if defaultTracer != nil {
+		t.Fatal("tracing enabled")
+	}
+	sp := startSpan(nil, "VolumeDriver.Get")
+	if sp != nil {
+		t.Fatal("got a span with tracing disabled")
+	}
+	child := startSpan(sp, "fileapi GET file")
+	child.SetAttribute("share", "myshare")
+	child.FinishErr(nil)
+	sp.Finish("failed")
+}
+
+func TestSpanFileExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "azurefile-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "spans.json")
+	if err := setupTracing(file, ""); err != nil {
+		t.Fatal(err)
+	}
+	tr := defaultTracer
+	defer func() { defaultTracer = nil }()
+
+	parent := startSpan(nil, "VolumeDriver.Mount")
+	parent.SetAttribute("volume.name", "myvol")
+	child := startSpan(parent, "mount.cifs")
+	child.SetAttribute("attempt", 1)
+	child.FinishErr(os.ErrPermission)
+	child.SetAttribute("late", "ignored")
+	child.Finish("") // finishing twice exports once
+	parent.Finish("")
+	if err := tr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	startSpan(nil, "after close").Finish("") // dropped
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var spans []*span
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		s := new(span)
+		if err := json.Unmarshal(sc.Bytes(), s); err != nil {
+			t.Fatalf("%s: %v", sc.Text(), err)
+		}
+		spans = append(spans, s)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+	c, p := spans[0], spans[1]
+	if c.Name != "mount.cifs" || p.Name != "VolumeDriver.Mount" {
+		t.Errorf("got spans %q, %q", c.Name, p.Name)
+	}
+	if c.TraceID != p.TraceID || len(p.TraceID) != 32 || c.ParentID != p.SpanID || p.ParentID != "" || len(c.SpanID) != 16 {
+		t.Errorf("got child %+v of parent %+v", c, p)
+	}
+	if c.Error != os.ErrPermission.Error() || p.Error != "" {
+		t.Errorf("got errors %q, %q", c.Error, p.Error)
+	}
+	if c.Attributes["attempt"] != "1" || c.Attributes["late"] != "" || p.Attributes["volume.name"] != "myvol" {
+		t.Errorf("got attributes %v, %v", c.Attributes, p.Attributes)
+	}
+	if c.EndTime.Before(c.StartTime) || p.StartTime.After(c.StartTime) {
+		t.Errorf("got times %v-%v in %v-%v", c.StartTime, c.EndTime, p.StartTime, p.EndTime)
+	}
+}
+
+func TestOTLPExport(t *testing.T) {
+	var got struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpKeyValue `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	status := http.StatusOK
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/otlp/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s request to %s", r.Header.Get("Content-Type"), r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(status)
+	}))
+	defer collector.Close()
+
+	e, err := newOTLPExporter(collector.URL + "/otlp/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1760868000, 5)
+	spans := []*span{
+		{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "b7ad6b7169203331", Name: "VolumeDriver.Create",
+			StartTime: start, EndTime: start.Add(time.Second), Attributes: map[string]string{"volume.name": "myvol"}},
+		{TraceID: "0af7651916cd43dd8448eb211c80319c", SpanID: "00f067aa0ba902b7", ParentID: "b7ad6b7169203331",
+			Name: "fileapi PUT share", StartTime: start, EndTime: start, Error: "409 Conflict"},
+	}
+	if err := e.export(spans); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.ResourceSpans) != 1 || len(got.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("got %+v", got)
+	}
+	res := got.ResourceSpans[0]
+	if a := res.Resource.Attributes; len(a) == 0 || a[0].Key != "service.name" || a[0].Value.StringValue != traceServiceName {
+		t.Errorf("got resource attributes %+v", a)
+	}
+	out := res.ScopeSpans[0].Spans
+	if len(out) != 2 {
+		t.Fatalf("got %d spans, want 2", len(out))
+	}
+	if o := out[0]; o.Name != "VolumeDriver.Create" || o.ParentSpanID != "" || o.Status.Code != 0 ||
+		o.StartTimeUnixNano != "1760868000000000005" || o.EndTimeUnixNano != strconv.FormatInt(start.Add(time.Second).UnixNano(), 10) ||
+		len(o.Attributes) != 1 || o.Attributes[0].Key != "volume.name" || o.Attributes[0].Value.StringValue != "myvol" {
+		t.Errorf("got span %+v", o)
+	}
+	if o := out[1]; o.ParentSpanID != "b7ad6b7169203331" || o.Status.Code != 2 || o.Status.Message != "409 Conflict" || o.Kind != 1 {
+		t.Errorf("got span %+v", o)
+	}
+
+	status = http.StatusServiceUnavailable
+	if err := e.export(spans); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("got error %v, want collector error", err)
+	}
+}
+
+func TestSetupTracingInvalid(t *testing.T) {
+	if err := setupTracing("spans.json", "http://collector:4318"); err == nil {
+		t.Error("file and OTLP endpoint accepted together")
+	}
+	if err := setupTracing("", "collector:4318"); err == nil || !strings.Contains(err.Error(), "must be an http:// or https:// URL") {
+		t.Errorf("got error %v", err)
+	}
+	if defaultTracer != nil {
+		t.Error("tracing enabled")
+	}
+}
@@ -4,20 +4,22 @@ package main
 // - removed '[argument...]' at the end of USAGE line
 // - changed '[global options]' with '[options]'
 // - changed 'GLOBAL OPTIONS' with 'OPTIONS'
-// - removed 'COMMANDS' section entirely (was showing only 'help,h' anyway)
-// - removed '{{if .Commands}} command [command options]{{end}}' from the line after 'USAGE'
+// - changed ' command [command options]' after 'USAGE' to optional, as the driver runs without a command
 const usageTemplate = `NAME:
    {{.Name}} - {{.Usage}}
 
 USAGE:
-   {{.Name}} {{if .Flags}}[options]{{end}}
+   {{.Name}} {{if .Flags}}[options]{{end}}{{if .Commands}} [command [command options]]{{end}}
    {{if .Version}}
 VERSION:
    {{.Version}}
    {{end}}{{if len .Authors}}
 AUTHOR(S):
    {{range .Authors}}{{ . }}{{end}}
-   {{end}}{{if .Flags}}
+   {{end}}{{if .Commands}}
+COMMANDS:
+   {{range .Commands}}{{join .Names ", "}}{{ "\t" }}{{.Usage}}
+   {{end}}{{end}}{{if .Flags}}
 OPTIONS:
    {{range .Flags}}{{.}}
    {{end}}{{end}}{{if .Copyright }}
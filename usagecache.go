@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// usageCacheTTL is how long the usage of a volume directory is reported
+// without walking the directory again.
+const usageCacheTTL = 5 * time.Minute
+
+// usageCache remembers the usage of volume directories. Docker inspects
+// volumes on every container start, and walking a directory tree takes a
+// listing request per directory, so the usage is computed at most once per
+// TTL for each directory; concurrent requests wait for the same walk.
+type usageCache struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*usageEntry
+}
+
+type usageEntry struct {
+	done  chan struct{} // closed when files, bytes and err are set
+	files int
+	bytes int64
+	err   error
+	at    time.Time
+}
+
+func newUsageCache(ttl time.Duration) *usageCache {
+	return &usageCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]*usageEntry),
+	}
+}
+
+// get returns the usage of dir in share, calling compute unless a result
+// younger than the TTL is cached. Errors are not cached.
+func (c *usageCache) get(share, dir string, compute func() (int, int64, error)) (int, int64, error) {
+	key := share + "/" + dir
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok {
+		select {
+		case <-e.done:
+			if c.now().Sub(e.at) >= c.ttl {
+				ok = false
+			}
+		default:
+			// computation in progress
+		}
+	}
+	if !ok {
+		e = &usageEntry{done: make(chan struct{})}
+		c.entries[key] = e
+		c.mu.Unlock()
+
+		e.files, e.bytes, e.err = compute()
+		e.at = c.now()
+		c.mu.Lock()
+		if e.err != nil && c.entries[key] == e {
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+		close(e.done)
+		return e.files, e.bytes, e.err
+	}
+	c.mu.Unlock()
+	<-e.done
+	return e.files, e.bytes, e.err
+}
+
+// forget drops the cached usage of dir in share.
+func (c *usageCache) forget(share, dir string) {
+	c.mu.Lock()
+	delete(c.entries, share+"/"+dir)
+	c.mu.Unlock()
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUsageCache(t *testing.T) {
+	now := time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC)
+	c := newUsageCache(time.Minute)
+	c.now = func() time.Time { return now }
+
+	var calls int
+	compute := func() (int, int64, error) {
+		calls++
+		return calls, int64(calls) * 100, nil
+	}
+	get := func(share string) int {
+		files, _, err := c.get(share, "dir", compute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return files
+	}
+
+	if got := get("share"); got != 1 {
+		t.Errorf("first get: got %d files, want 1", got)
+	}
+	now = now.Add(30 * time.Second)
+	if got := get("share"); got != 1 {
+		t.Errorf("cached get: got %d files, want 1", got)
+	}
+	if got := get("other"); got != 2 {
+		t.Errorf("other share: got %d files, want 2", got)
+	}
+	now = now.Add(30 * time.Second)
+	if got := get("share"); got != 3 {
+		t.Errorf("expired get: got %d files, want 3", got)
+	}
+	c.forget("share", "dir")
+	if got := get("share"); got != 4 {
+		t.Errorf("get after forget: got %d files, want 4", got)
+	}
+
+	// errors are not cached
+	fail := errors.New("listing failed")
+	if _, _, err := c.get("share", "broken", func() (int, int64, error) { return 0, 0, fail }); err != fail {
+		t.Errorf("got error %v, want %v", err, fail)
+	}
+	if files, _, err := c.get("share", "broken", compute); err != nil || files != 5 {
+		t.Errorf("get after error: got %d files, %v", files, err)
+	}
+}
+
+func TestUsageCacheConcurrent(t *testing.T) {
+	c := newUsageCache(time.Minute)
+	var calls int32
+	release := make(chan struct{})
+	compute := func() (int, int64, error) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return 7, 700, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if files, bytes, err := c.get("share", "dir", compute); err != nil || files != 7 || bytes != 700 {
+				t.Errorf("got %d files, %d bytes, %v", files, bytes, err)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("directory walked %d times, want once", calls)
+	}
+}